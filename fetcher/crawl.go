@@ -0,0 +1,290 @@
+package fetcher
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultCrawlKind = "FetcherCrawledURL"
+	// DefaultCrawlBatch is the number of URLs per enqueued crawl request
+	DefaultCrawlBatch = 50
+	DefaultCrawlTTL   = 7 * 24 * time.Hour
+)
+
+// Crawl turns a FetchRequest into a crawl: links found in fetched HTML are
+// fetched as well, up to MaxDepth links away from the seed URLs. Only
+// links to Domains (or their subdomains, the seed hosts if empty) that
+// match one of Include and none of Exclude are followed. URLs are fetched
+// once per crawl ID, derived from the seed task if empty. Pages found
+// unchanged by Conditional have no content to parse, so their links are
+// only followed again once they change.
+type Crawl struct {
+	ID       string   `json:"id,omitempty"`
+	Domains  []string `json:"domains,omitempty"`
+	Include  []string `json:"include,omitempty"`
+	Exclude  []string `json:"exclude,omitempty"`
+	MaxDepth int      `json:"max_depth"`
+	Depth    int      `json:"depth,omitempty"`
+}
+
+// CrawledURL is the entity marking a URL as seen by a crawl until
+// Expires.
+type CrawledURL struct {
+	URL     string `datastore:",noindex"`
+	Crawl   string
+	Depth   int
+	Created time.Time
+	Expires time.Time
+}
+
+func (f *Fetcher) crawlKind() string {
+	if f.CrawlKind != "" {
+		return f.CrawlKind
+	}
+	return DefaultCrawlKind
+}
+
+func (f *Fetcher) crawlTTL() time.Duration {
+	if f.CrawlTTL > 0 {
+		return f.CrawlTTL
+	}
+	return DefaultCrawlTTL
+}
+
+// crawlID derives the ID of a crawl from its seed task, so that a retried
+// task keeps it, or from its seed URLs and start time outside the task
+// queue.
+func crawlID(request *FetchRequest, seeds []string, now time.Time) string {
+	if r := request.Request; r != nil && r.Header.Get("X-AppEngine-TaskName") != "" {
+		return urlHash(r.Header.Get("X-AppEngine-QueueName") + "\n" + r.Header.Get("X-AppEngine-TaskName"))
+	}
+	return urlHash(strings.Join(seeds, "\n") + "\n" + now.Format(time.RFC3339Nano))
+}
+
+func (f *Fetcher) crawlKey(c context.Context, id, u string) *datastore.Key {
+	return datastore.NewKey(c, f.crawlKind(), urlHash(id+"\n"+u), 0, nil)
+}
+
+// stripPort returns host without its port, if any.
+func stripPort(host string) string {
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.HasSuffix(host, "]") {
+		return host[:i]
+	}
+	return host
+}
+
+func inDomains(host string, domains []string) bool {
+	host = stripPort(strings.ToLower(host))
+	for _, d := range domains {
+		d = strings.ToLower(d)
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, len(patterns))
+	for i, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("fetcher: crawl pattern %q: %v", p, err)
+		}
+		res[i] = re
+	}
+	return res, nil
+}
+
+// filter returns the links within the scope of the crawl.
+func (s *Crawl) filter(links []string) ([]string, error) {
+	include, err := compilePatterns(s.Include)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := compilePatterns(s.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+links:
+	for _, link := range links {
+		u, err := url.Parse(link)
+		if err != nil || !inDomains(u.Host, s.Domains) {
+			continue
+		}
+		for _, re := range exclude {
+			if re.MatchString(link) {
+				continue links
+			}
+		}
+		matched := len(include) == 0
+		for _, re := range include {
+			if re.MatchString(link) {
+				matched = true
+				break
+			}
+		}
+		if matched {
+			result = append(result, link)
+		}
+	}
+	return result, nil
+}
+
+// unseen returns the urls the crawl hasn't fetched or enqueued yet, or
+// whose marker has expired.
+func (f *Fetcher) unseen(c context.Context, id string, urls []string) ([]string, error) {
+	var result []string
+	now := time.Now()
+	err := eachBatch(len(urls), func(start, end int) error {
+		batch := urls[start:end]
+		keys := make([]*datastore.Key, len(batch))
+		for j := range batch {
+			keys[j] = f.crawlKey(c, id, batch[j])
+		}
+		dst := make([]CrawledURL, len(batch))
+		err := datastore.GetMulti(c, keys, dst)
+		me, ok := err.(appengine.MultiError)
+		if err != nil && !ok {
+			return err
+		}
+		for j := range batch {
+			if ok && me[j] != nil && me[j] != datastore.ErrNoSuchEntity {
+				return me[j]
+			}
+			if (ok && me[j] == datastore.ErrNoSuchEntity) || dst[j].Expires.Before(now) {
+				result = append(result, batch[j])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (f *Fetcher) markSeen(c context.Context, id string, urls []string, depth int) error {
+	now := time.Now()
+	expires := now.Add(f.crawlTTL())
+	return eachBatch(len(urls), func(start, end int) error {
+		batch := urls[start:end]
+		keys := make([]*datastore.Key, len(batch))
+		src := make([]*CrawledURL, len(batch))
+		for j := range batch {
+			keys[j] = f.crawlKey(c, id, batch[j])
+			src[j] = &CrawledURL{URL: batch[j], Crawl: id, Depth: depth, Created: now,
+				Expires: expires}
+		}
+		_, err := datastore.PutMulti(c, keys, src)
+		return err
+	})
+}
+
+// Crawl enqueues the unseen in-scope links of the HTML entries as new
+// requests one level deeper. Nothing is done unless request has a Crawl
+// below its MaxDepth.
+func (f *Fetcher) Crawl(request *FetchRequest, entries []*FetchResponse) error {
+	spec := request.Crawl
+	if spec == nil {
+		return nil
+	}
+	c := request.Context
+	if spec.Depth == 0 {
+		seeds := make([]string, len(request.URLs))
+		for i := range request.URLs {
+			seeds[i] = request.URLs[i].URL
+		}
+		if spec.ID == "" {
+			spec.ID = crawlID(request, seeds, time.Now())
+		}
+		if len(spec.Domains) == 0 {
+			for _, u := range seeds {
+				if h := stripPort(hostOf(u)); h != "" {
+					spec.Domains = append(spec.Domains, h)
+				}
+			}
+		}
+		if err := f.markSeen(c, spec.ID, seeds, 0); err != nil {
+			return err
+		}
+	}
+	if spec.Depth >= spec.MaxDepth {
+		return nil
+	}
+
+	var links []string
+	found := make(map[string]bool)
+	for _, e := range entries {
+		if e.NotModified || !isHTML(e.ContentType) {
+			continue
+		}
+		base, err := url.Parse(e.FinalURL)
+		if err != nil {
+			continue
+		}
+		for _, link := range extractLinks(base, e.Content) {
+			if !found[link] {
+				found[link] = true
+				links = append(links, link)
+			}
+		}
+	}
+	links, err := spec.filter(links)
+	if err != nil {
+		return err
+	}
+	links, err = f.unseen(c, spec.ID, links)
+	if err != nil {
+		return err
+	}
+
+	batch := f.CrawlBatch
+	if batch <= 0 {
+		batch = DefaultCrawlBatch
+	}
+	for i := 0; i < len(links); i += batch {
+		urls := links[i:]
+		if len(urls) > batch {
+			urls = urls[:batch]
+		}
+		next := *spec
+		next.Depth++
+		nextRequest := FetchRequest{URLs: Targets(urls...), Topic: request.Topic,
+			Topics: request.Topics, Sink: request.Sink, Workers: request.Workers,
+			Transform: request.Transform, Crawl: &next}
+		if err := f.enqueue(request, &nextRequest, 0); err != nil {
+			return err
+		}
+		// Marked after enqueueing, so that a failed task finds them again
+		if err := f.markSeen(c, spec.ID, urls, next.Depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CleanupCrawls deletes the expired CrawledURL markers.
+func (f *Fetcher) CleanupCrawls(c context.Context) (CleanupResult, error) {
+	return deleteExpired(c, f.crawlKind())
+}
+
+// HandleCrawlCleanup runs CleanupCrawls, typically from cron, and writes
+// its CleanupResult.
+func (f *Fetcher) HandleCrawlCleanup(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	result, err := f.CleanupCrawls(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &result)
+}
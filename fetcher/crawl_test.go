@@ -0,0 +1,95 @@
+package fetcher
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInDomains(t *testing.T) {
+	tests := []struct {
+		host    string
+		domains []string
+		want    bool
+	}{
+		{"a.com", []string{"a.com"}, true},
+		{"www.A.com", []string{"a.com"}, true},
+		{"a.com:8080", []string{"a.com"}, true},
+		{"a.com:8080", []string{stripPort(hostOf("http://a.com:8080/"))}, true},
+		{"sub.a.com:8080", []string{"A.com"}, true},
+		{"ba.com", []string{"a.com"}, false},
+		{"a.com.evil", []string{"a.com"}, false},
+		{"[::1]", []string{"[::1]"}, true},
+		{"b.com", nil, false},
+	}
+	for _, test := range tests {
+		if got := inDomains(test.host, test.domains); got != test.want {
+			t.Errorf("inDomains(%q, %q) = %v, want %v", test.host, test.domains, got, test.want)
+		}
+	}
+}
+
+func TestCrawlFilter(t *testing.T) {
+	links := []string{
+		"http://a.com/page",
+		"http://a.com:8080/page",
+		"http://a.com/logout",
+		"http://b.com/page",
+		"http://a.com/docs/x",
+	}
+	tests := []struct {
+		crawl Crawl
+		want  []string
+	}{
+		{Crawl{Domains: []string{"a.com"}},
+			[]string{"http://a.com/page", "http://a.com:8080/page", "http://a.com/logout", "http://a.com/docs/x"}},
+		{Crawl{Domains: []string{"a.com"}, Exclude: []string{"/logout$"}},
+			[]string{"http://a.com/page", "http://a.com:8080/page", "http://a.com/docs/x"}},
+		{Crawl{Domains: []string{"a.com", "b.com"}, Include: []string{"/docs/", "^http://b"}},
+			[]string{"http://b.com/page", "http://a.com/docs/x"}},
+		{Crawl{Domains: []string{"c.com"}}, nil},
+	}
+	for i, test := range tests {
+		got, err := test.crawl.filter(links)
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%d: filter = %q, want %q", i, got, test.want)
+		}
+	}
+	if _, err := (&Crawl{Include: []string{"("}}).filter(links); err == nil {
+		t.Errorf("filter accepted an invalid pattern")
+	}
+}
+
+func TestCrawlID(t *testing.T) {
+	seeds := []string{"http://a.com/", "http://b.com/"}
+	task := func(queue, name string) *FetchRequest {
+		r, _ := http.NewRequest("POST", "/fetch", nil)
+		r.Header.Set("X-AppEngine-QueueName", queue)
+		r.Header.Set("X-AppEngine-TaskName", name)
+		return &FetchRequest{Request: r}
+	}
+	tests := []struct {
+		name   string
+		a, b   *FetchRequest
+		aTime  time.Time
+		bTime  time.Time
+		stable bool
+	}{
+		{"retried task", task("q", "t1"), task("q", "t1"), testTime, testTime.Add(time.Minute), true},
+		{"other task", task("q", "t1"), task("q", "t2"), testTime, testTime, false},
+		{"other queue", task("q", "t1"), task("r", "t1"), testTime, testTime, false},
+		{"no task", &FetchRequest{}, &FetchRequest{}, testTime, testTime, true},
+		{"no task later", &FetchRequest{}, &FetchRequest{}, testTime, testTime.Add(time.Nanosecond), false},
+	}
+	for _, test := range tests {
+		a, b := crawlID(test.a, seeds, test.aTime), crawlID(test.b, seeds, test.bTime)
+		if a == "" || (a == b) != test.stable {
+			t.Errorf("%s: crawl ids %q and %q, want equal %v", test.name, a, b, test.stable)
+		}
+	}
+}
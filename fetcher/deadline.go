@@ -0,0 +1,50 @@
+package fetcher
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"time"
+)
+
+// TimeoutError is returned for URLs cancelled by URLTimeout or Deadline.
+// It is transient, so those URLs are handed to Retry.
+type TimeoutError struct {
+	URL     string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("fetcher: %s timed out after %v", e.URL, e.Timeout)
+}
+
+// fetchTarget fetches t within URLTimeout, reporting a TimeoutError if
+// either that or the deadline of c expired.
+func (f *Fetcher) fetchTarget(c context.Context, request *FetchRequest, t *Target, state *URLState) (*FetchResponse, error) {
+	uc := c
+	if f.URLTimeout > 0 {
+		var cancel context.CancelFunc
+		uc, cancel = context.WithTimeout(c, f.URLTimeout)
+		defer cancel()
+	}
+	resp, err := f.fetchURL(uc, request, t, state)
+	if err != nil {
+		if c.Err() != nil {
+			return nil, &TimeoutError{URL: t.URL, Timeout: f.Deadline}
+		}
+		if uc.Err() != nil {
+			return nil, &TimeoutError{URL: t.URL, Timeout: f.URLTimeout}
+		}
+	}
+	return resp, err
+}
+
+// timedOut returns a TimeoutError for every target still in pending.
+func (f *Fetcher) timedOut(targets []*Target, pending map[*Target]bool) (errors []*FetchError) {
+	for _, t := range targets {
+		if pending[t] {
+			errors = append(errors, &FetchError{URL: t.URL, Target: t,
+				Error: &TimeoutError{URL: t.URL, Timeout: f.Deadline}})
+		}
+	}
+	return
+}
@@ -0,0 +1,105 @@
+package fetcher
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"golang.org/x/net/html/charset"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// decompress undoes the Content-Encoding of resp. Output beyond MaxBodySize
+// is cut like an oversize body. Empty bodies, as those of HEAD requests and
+// 204 responses, are returned as they are.
+func (f *Fetcher) decompress(resp *http.Response, body []byte, truncated bool) ([]byte, bool, error) {
+	if len(body) == 0 {
+		resp.Header.Del("Content-Encoding")
+		return body, truncated, nil
+	}
+	var r io.Reader
+	var err error
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// Servers disagree on whether deflate means zlib or raw deflate
+		r, err = zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			r, err = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	default:
+		return body, truncated, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if f.MaxBodySize > 0 {
+		r = io.LimitReader(r, f.MaxBodySize+1)
+	}
+	decoded, err := ioutil.ReadAll(r)
+	// A truncated stream ends early, keep what could be decoded
+	if err == io.ErrUnexpectedEOF && truncated {
+		err = nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if f.MaxBodySize > 0 && int64(len(decoded)) > f.MaxBodySize {
+		decoded, truncated = decoded[:f.MaxBodySize], true
+	}
+	resp.Header.Del("Content-Encoding")
+	return decoded, truncated, nil
+}
+
+func isText(mediatype string) bool {
+	switch {
+	case strings.HasPrefix(mediatype, "text/"),
+		mediatype == "application/xhtml+xml",
+		mediatype == "application/xml",
+		mediatype == "application/json",
+		strings.HasSuffix(mediatype, "+xml"),
+		strings.HasSuffix(mediatype, "+json"):
+		return true
+	}
+	return false
+}
+
+// transcode converts text bodies to UTF-8 using the charset of the
+// Content-Type, a byte order mark or a meta tag, and returns the charset
+// it was converted from.
+func transcode(resp *http.Response, body []byte) ([]byte, string, error) {
+	contentType := resp.Header.Get("Content-Type")
+	mediatype, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !isText(mediatype) {
+		return body, "", nil
+	}
+	enc, name, _ := charset.DetermineEncoding(body, contentType)
+	if name == "utf-8" {
+		return body, name, nil
+	}
+	decoded, err := enc.NewDecoder().Bytes(body)
+	if err != nil {
+		return nil, "", err
+	}
+	// The byte order mark of UTF-16 bodies survives decoding
+	decoded = bytes.TrimPrefix(decoded, []byte("\ufeff"))
+	params["charset"] = "utf-8"
+	resp.Header.Set("Content-Type", mime.FormatMediaType(mediatype, params))
+	return decoded, name, nil
+}
+
+// decode decompresses body and transcodes it to UTF-8, updating the
+// headers of resp to match.
+func (f *Fetcher) decode(resp *http.Response, body []byte, truncated bool) (decoded []byte, cut bool, charset string, err error) {
+	decoded, cut, err = f.decompress(resp, body, truncated)
+	if err != nil {
+		return
+	}
+	decoded, charset, err = transcode(resp, decoded)
+	return
+}
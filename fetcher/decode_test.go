@@ -0,0 +1,135 @@
+package fetcher
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func compress(t *testing.T, encoding string, content []byte) []byte {
+	var b bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&b)
+	case "zlib":
+		w = zlib.NewWriter(&b)
+	case "deflate":
+		var err error
+		if w, err = flate.NewWriter(&b, flate.DefaultCompression); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func encodedResponse(encoding, contentType string) *http.Response {
+	resp := &http.Response{Header: make(http.Header)}
+	if encoding != "" {
+		resp.Header.Set("Content-Encoding", encoding)
+	}
+	resp.Header.Set("Content-Type", contentType)
+	return resp
+}
+
+func TestDecompress(t *testing.T) {
+	content := []byte(strings.Repeat("hello, world\n", 1000))
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+	}{
+		{"identity", "", content},
+		{"gzip", "gzip", compress(t, "gzip", content)},
+		{"x-gzip", "x-gzip", compress(t, "gzip", content)},
+		{"zlib deflate", "deflate", compress(t, "zlib", content)},
+		{"raw deflate", "deflate", compress(t, "deflate", content)},
+	}
+	f := &Fetcher{}
+	for _, test := range tests {
+		resp := encodedResponse(test.encoding, "text/plain")
+		decoded, truncated, err := f.decompress(resp, test.body, false)
+		if err != nil || truncated || !bytes.Equal(decoded, content) {
+			t.Errorf("%s: decompress = %d bytes, %v, %v", test.name, len(decoded), truncated, err)
+		}
+		if resp.Header.Get("Content-Encoding") != "" {
+			t.Errorf("%s: Content-Encoding left", test.name)
+		}
+	}
+}
+
+func TestDecompressEmpty(t *testing.T) {
+	f := &Fetcher{Decode: true}
+	for _, encoding := range []string{"gzip", "deflate"} {
+		resp := encodedResponse(encoding, "text/html")
+		decoded, truncated, charset, err := f.decode(resp, []byte{}, false)
+		if err != nil || len(decoded) != 0 || truncated {
+			t.Errorf("%s: decode of an empty body = %q, %v, %q, %v", encoding, decoded, truncated, charset, err)
+		}
+	}
+}
+
+func TestDecompressTruncated(t *testing.T) {
+	content := make([]byte, 100<<10)
+	for i := range content {
+		content[i] = byte(i * 7 % 251)
+	}
+	for _, encoding := range []string{"gzip", "zlib"} {
+		f := &Fetcher{MaxBodySize: 1000}
+		// readBody cuts the compressed stream at MaxBodySize
+		body := compress(t, encoding, content)[:f.MaxBodySize]
+		header := encoding
+		if encoding == "zlib" {
+			header = "deflate"
+		}
+		resp := encodedResponse(header, "application/octet-stream")
+		decoded, truncated, err := f.decompress(resp, body, true)
+		if err != nil || !truncated || int64(len(decoded)) > f.MaxBodySize || !bytes.HasPrefix(content, decoded) {
+			t.Errorf("%s: decompress of a cut stream = %d bytes, %v, %v", encoding, len(decoded), truncated, err)
+		}
+	}
+
+	// A stream cut without the body being truncated is an error
+	f := &Fetcher{}
+	body := compress(t, "gzip", content)
+	if _, _, err := f.decompress(encodedResponse("gzip", "text/plain"), body[:len(body)/2], false); err == nil {
+		t.Errorf("decompress accepted a corrupt stream")
+	}
+}
+
+func TestTranscode(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+		charset     string
+	}{
+		{"header", "text/plain; charset=iso-8859-1", "caf\xe9", "café", "windows-1252"},
+		{"meta tag", "text/html", `<meta charset="iso-8859-15"><p>caf` + "\xe9", `<meta charset="iso-8859-15"><p>café`, "iso-8859-15"},
+		{"bom", "text/plain", "\xff\xfec\x00a\x00f\x00\xe9\x00", "café", "utf-16le"},
+		{"utf-8", "text/html; charset=utf-8", "café", "café", "utf-8"},
+		{"binary", "image/png", "caf\xe9", "caf\xe9", ""},
+	}
+	for _, test := range tests {
+		resp := encodedResponse("", test.contentType)
+		decoded, charset, err := transcode(resp, []byte(test.body))
+		if err != nil || string(decoded) != test.want || charset != test.charset {
+			t.Errorf("%s: transcode = %q, %q, %v, want %q, %q", test.name, decoded, charset, err, test.want, test.charset)
+		}
+		if test.charset != "" && test.charset != "utf-8" && !strings.Contains(resp.Header.Get("Content-Type"), "charset=utf-8") {
+			t.Errorf("%s: Content-Type = %q, want utf-8", test.name, resp.Header.Get("Content-Type"))
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package fetcher
+
+import (
+	"encoding/json"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"time"
+)
+
+// FetchExecution is the entity recorded for every request served, with
+// the FetchStat encoded as JSON in Stat. A request that failed records
+// its Error and the outcomes reached before it.
+type FetchExecution struct {
+	Started  time.Time
+	Duration time.Duration `datastore:",noindex"`
+	Path     string        `datastore:",noindex"`
+	Queue    string        `datastore:",noindex"`
+	Attempt  int           `datastore:",noindex"`
+	Stat     []byte        `datastore:",noindex"`
+	Error    string        `datastore:",noindex"`
+}
+
+// URLFailure is the entity recording the last failure of a URL, removed
+// once the URL is fetched successfully.
+type URLFailure struct {
+	URL       string `datastore:",noindex"`
+	Error     string `datastore:",noindex"`
+	Attempts  int    `datastore:",noindex"`
+	Permanent bool   `datastore:",noindex"`
+	Updated   time.Time
+}
+
+func (f *Fetcher) failureKey(c context.Context, url string) *datastore.Key {
+	return datastore.NewKey(c, f.FailureKind, urlHash(url), 0, nil)
+}
+
+func (f *Fetcher) recordExecution(request *FetchRequest, s *FetchStat, started time.Time, runErr error) {
+	if f.ExecutionKind == "" {
+		return
+	}
+	stat, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	e := &FetchExecution{
+		Started:  started,
+		Duration: time.Since(started),
+		Path:     request.Request.URL.Path,
+		Queue:    request.Request.Header.Get("X-AppEngine-QueueName"),
+		Attempt:  request.Attempt,
+		Stat:     stat,
+	}
+	if runErr != nil {
+		e.Error = runErr.Error()
+	}
+	c := request.Context
+	if _, err := datastore.Put(c, datastore.NewIncompleteKey(c, f.ExecutionKind, nil), e); err != nil {
+		log.Warningf(c, "fetcher: recording execution: %v", err)
+	}
+}
+
+// recordFailures stores the failures of errors and clears those of the
+// URLs in result.
+func (f *Fetcher) recordFailures(request *FetchRequest, result []*FetchResponse, errors []*FetchError) {
+	if f.FailureKind == "" {
+		return
+	}
+	c := request.Context
+	now := time.Now()
+	// A failed batch is logged and the others still written
+	eachBatch(len(errors), func(start, end int) error {
+		batch := errors[start:end]
+		keys := make([]*datastore.Key, len(batch))
+		src := make([]*URLFailure, len(batch))
+		for j, e := range batch {
+			keys[j] = f.failureKey(c, e.URL)
+			src[j] = &URLFailure{URL: e.URL, Error: e.Error.Error(),
+				Attempts: request.Attempt + 1, Permanent: e.Permanent, Updated: now}
+		}
+		if _, err := datastore.PutMulti(c, keys, src); err != nil {
+			log.Warningf(c, "fetcher: recording failures: %v", err)
+		}
+		return nil
+	})
+	eachBatch(len(result), func(start, end int) error {
+		batch := result[start:end]
+		keys := make([]*datastore.Key, len(batch))
+		for j, e := range batch {
+			keys[j] = f.failureKey(c, e.URL)
+		}
+		if err := datastore.DeleteMulti(c, keys); err != nil {
+			log.Warningf(c, "fetcher: clearing failures: %v", err)
+		}
+		return nil
+	})
+}
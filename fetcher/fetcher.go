@@ -1,46 +1,191 @@
 package fetcher
 
 import (
-	"encoding/base64"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/pubsub/v1beta2"
 	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/taskqueue"
-	"google.golang.org/appengine/urlfetch"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
+	"sync"
+	"time"
 )
 
+const DefaultWorkers = 10
+
 type FetchRequest struct {
-	URLs    []string        `json:"urls"`
-	Topic   string          `json:"topic"`
-	Context context.Context `json:"-"`
-	Request *http.Request   `json:"-"`
+	URLs      []Target        `json:"urls"`
+	Sink      string          `json:"sink,omitempty"`
+	Topic     string          `json:"topic"`
+	Topics    []string        `json:"topics,omitempty"`
+	Workers   int             `json:"workers,omitempty"`
+	Transform []TransformSpec `json:"transform,omitempty"`
+	Crawl     *Crawl          `json:"crawl,omitempty"`
+	Attempt   int             `json:"attempt,omitempty"`
+	Context   context.Context `json:"-"`
+	Request   *http.Request   `json:"-"`
+
+	// sync is set for ServeSync, which never fetches conditionally
+	sync bool
 }
 
 type FetchResponse struct {
-	URL     string
-	Content []byte
+	URL      string
+	Target   *Target
+	Content  []byte
+	FinalURL string
+	// Redirects lists the URLs that redirected, in order
+	Redirects   []string
+	StatusCode  int
+	ContentType string
+	// Charset is the charset the content was transcoded from by Decode
+	Charset      string
+	Fetched      time.Time
+	Latency      time.Duration
+	ETag         string
+	LastModified string
+	Hash         string
+	Truncated    bool
+	// StorageURL is the gs:// location of offloaded content
+	StorageURL string
+	// NotModified is set when a conditional fetch returned 304
+	NotModified bool
 }
 
 type FetchError struct {
-	URL   string
-	Error error
+	URL    string
+	Target *Target
+	Error  error
+	// Topic is set when only publishing to that topic failed
+	Topic string
+	// Permanent errors are reported but not retried
+	Permanent bool
+	Latency   time.Duration
 }
 
 type Fetcher struct {
-	Raw   bool
-	Topic string
+	Raw    bool
+	Topic  string
+	Topics []string
+	Format MessageFormat
+	// Transformers rewrite every entry before it is published, unless the
+	// request selects its own chain out of the built-in transformers and
+	// NamedTransformers.
+	Transformers      []Transformer
+	NamedTransformers map[string]Transformer
+	// CrawlKind is the kind of the CrawledURL entities of crawl requests,
+	// DefaultCrawlKind if empty. CrawlBatch bounds the URLs enqueued per
+	// task, DefaultCrawlBatch if zero. Seen URLs are fetched again after
+	// CrawlTTL, DefaultCrawlTTL if zero.
+	CrawlKind  string
+	CrawlBatch int
+	CrawlTTL   time.Duration
+	// Decode decompresses gzip and deflate bodies and transcodes text to
+	// UTF-8 before publishing.
+	Decode bool
+	// Sink receives the fetched entries, a PubsubSink if nil. Requests can
+	// select one of Sinks by name instead.
+	Sink  Sink
+	Sinks map[string]Sink
+	// StatusPolicy classifies response status codes, falling back to
+	// DefaultStatusClass.
+	StatusPolicy StatusPolicy
+	// Redirect controls which redirects are followed, all of them up to
+	// DefaultMaxRedirects by default.
+	Redirect RedirectPolicy
+	// MaxBodySize limits the bytes read from a response, handling larger
+	// bodies according to Oversize. Zero means no limit.
+	MaxBodySize int64
+	Oversize    OversizePolicy
+	// PublishWorkers is the number of batches published concurrently.
+	PublishWorkers int
+	// OffloadBucket enables writing content larger than OffloadThreshold
+	// (DefaultOffloadThreshold if zero) to Cloud Storage and publishing
+	// a reference instead. StorageEndpoint overrides the API base path.
+	OffloadBucket    string
+	OffloadThreshold int
+	StorageEndpoint  string
+	// Workers is the number of concurrent fetches per request,
+	// DefaultWorkers if zero. FetchRequest.Workers can only lower it, so
+	// that a task payload can't raise the urlfetch concurrency.
+	Workers int
+	// URLTimeout bounds the fetch of a single URL and Deadline the whole
+	// Fetch. URLs cancelled by either are retried. Zero means no limit.
+	URLTimeout time.Duration
+	Deadline   time.Duration
+	// RateLimit applies to every host not listed in HostRateLimits,
+	// DefaultRateLimit if zero. Use Unlimited to disable limiting.
+	RateLimit      RateLimit
+	HostRateLimits map[string]RateLimit
+	// Robots enables robots.txt compliance for UserAgent, with robots.txt
+	// cached for RobotsTTL (DefaultRobotsTTL if zero).
+	Robots    bool
+	RobotsTTL time.Duration
+	UserAgent string
+	// Conditional sends If-None-Match and If-Modified-Since using the
+	// validators kept in StateStore (a DatastoreStateStore if nil).
+	Conditional bool
+	// Dedup suppresses publishing content identical to the last published
+	// content of the same URL, tracked in StateStore as well.
+	Dedup      bool
+	StateStore StateStore
+	// MaxAttempts bounds the executions of a URL, after which it is sent
+	// to DeadLetterTopic and/or stored as DeadLetterKind. Retries are
+	// delayed by RetryDelay, doubling on every attempt up to MaxRetryDelay.
+	MaxAttempts     int
+	RetryDelay      time.Duration
+	MaxRetryDelay   time.Duration
+	DeadLetterTopic string
+	DeadLetterKind  string
+	// ExecutionKind and FailureKind enable recording every request served
+	// as a FetchExecution and the last failure of every URL as a
+	// URLFailure, as shown by the admin pages. AdminPath is the path of
+	// this handler, where the admin pages submit requests. AdminJobs lists
+	// the jobs of a dispatcher on the admin pages as well.
+	ExecutionKind string
+	FailureKind   string
+	AdminPath     string
+	AdminJobs     *JobDispatcher
+	// HistoryKind enables recording the outcome of every fetch as a
+	// FetchRecord, kept for HistoryTTL (DefaultHistoryTTL if zero).
+	HistoryKind string
+	HistoryTTL  time.Duration
+	// Metrics enables writing custom metrics of fetch outcomes, latency,
+	// bytes, publish failures and retries, named after MetricPrefix
+	// (DefaultMetricPrefix if empty). Descriptors are created on first use.
+	// Each instance aggregates its requests and writes them every
+	// MetricsInterval (DefaultMetricsInterval if zero), on the next request
+	// served after it.
+	Metrics         bool
+	MetricPrefix    string
+	MetricsInterval time.Duration
+
+	mu          sync.Mutex
+	limiters    map[string]*limiter
+	robotsCache map[string]*robots
+	// metricsCreated is set once the metric descriptors exist
+	metricsCreated bool
+	metricsWindow  *metricsWindow
+	// apiClient replaces google.DefaultClient in tests
+	apiClient func(c context.Context, scope ...string) (*http.Client, error)
 }
 
 type FetchStat struct {
-	Total   int `json:"total"`
-	Success int `json:"success"`
-	Fail    int `json:"fail"`
+	Total     int `json:"total"`
+	Success   int `json:"success"`
+	Fail      int `json:"fail"`
+	Skipped   int `json:"skipped"`
+	Unchanged int `json:"unchanged"`
+	Duplicate int `json:"duplicate"`
+	Dropped   int `json:"dropped"`
+	// StatusCodes counts responses by HTTP status code
+	StatusCodes map[string]int `json:"status_codes,omitempty"`
 }
 
 func NewFetcher(raw bool, topic string) *Fetcher {
@@ -51,63 +196,178 @@ func (f *FetchRequest) AppID() string {
 	return appengine.AppID(f.Context)
 }
 
-func (f *Fetcher) fetchURL(r *FetchRequest, url string) (result *FetchResponse, err error) {
-	resp, err := urlfetch.Client(r.Context).Get(url)
+func (f *Fetcher) workers(request *FetchRequest) int {
+	n := f.Workers
+	if n <= 0 {
+		n = DefaultWorkers
+	}
+	if request.Workers > 0 && request.Workers < n {
+		n = request.Workers
+	}
+	if n > len(request.URLs) {
+		n = len(request.URLs)
+	}
+	return n
+}
+
+func (f *Fetcher) fetchURL(c context.Context, r *FetchRequest, t *Target, state *URLState) (result *FetchResponse, err error) {
+	// Invalid targets fail before robots.txt and rate limits are involved
+	req, err := f.newRequest(t)
 	if err != nil {
 		return
 	}
-	var content []byte
-	if f.Raw {
-		content, err = httputil.DumpResponse(resp, true)
-	} else {
-		defer resp.Body.Close()
-		content, err = ioutil.ReadAll(resp.Body)
+	if f.Robots {
+		if err = f.checkRobots(c, t.URL); err != nil {
+			return
+		}
+	}
+	if err = f.wait(c, t.URL); err != nil {
+		return
 	}
+	if state != nil && (req.Method == "GET" || req.Method == "HEAD") {
+		if state.ETag != "" {
+			req.Header.Set("If-None-Match", state.ETag)
+		}
+		if state.LastModified != "" {
+			req.Header.Set("If-Modified-Since", state.LastModified)
+		}
+	}
+	var redirects []string
+	resp, err := f.client(c, &redirects).Do(req)
 	if err != nil {
+		if re, ok := unwrapURLError(err).(*RedirectError); ok {
+			err = re
+		}
 		return
 	}
 	result = &FetchResponse{
-		URL:     url,
-		Content: content,
+		URL:          t.URL,
+		Target:       t,
+		FinalURL:     resp.Request.URL.String(),
+		Redirects:    redirects,
+		StatusCode:   resp.StatusCode,
+		ContentType:  resp.Header.Get("Content-Type"),
+		Fetched:      time.Now(),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		result.NotModified = true
+		return
+	}
+	if f.StatusPolicy.Class(resp.StatusCode) != StatusSuccess {
+		resp.Body.Close()
+		return nil, &StatusError{URL: t.URL, StatusCode: resp.StatusCode}
 	}
+	if f.Oversize == RejectOversize && f.MaxBodySize > 0 && resp.ContentLength > f.MaxBodySize {
+		resp.Body.Close()
+		return nil, &SizeError{URL: t.URL, Limit: f.MaxBodySize}
+	}
+	body, truncated, err := f.readBody(resp)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if f.Decode {
+		body, truncated, result.Charset, err = f.decode(resp, body, truncated)
+		if err != nil {
+			return nil, err
+		}
+		result.ContentType = resp.Header.Get("Content-Type")
+	}
+	if truncated && f.Oversize == RejectOversize {
+		return nil, &SizeError{URL: t.URL, Limit: f.MaxBodySize}
+	}
+	content := body
+	if f.Raw {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		content, err = httputil.DumpResponse(resp, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	result.Content = content
+	result.Truncated = truncated
+	// The dump of Raw responses varies with headers such as Date
+	result.Hash = contentHash(body)
 	return
 }
 
 func (f *Fetcher) Fetch(request *FetchRequest) (result []*FetchResponse, errors []*FetchError) {
-	resc, errc := make(chan *FetchResponse), make(chan *FetchError)
+	var states map[string]*URLState
+	if f.Conditional && !request.sync {
+		keys := make([]string, len(request.URLs))
+		for i := range request.URLs {
+			keys[i] = stateKey(&request.URLs[i])
+		}
+		states = f.loadStates(request, keys)
+	}
+	c := request.Context
+	if f.Deadline > 0 {
+		var cancel context.CancelFunc
+		c, cancel = context.WithTimeout(c, f.Deadline)
+		defer cancel()
+	}
+	targets := interleave(request.URLs)
+	targetc := make(chan *Target)
+	// Buffered, so that workers finishing after the deadline don't block
+	resc := make(chan *FetchResponse, len(targets))
+	errc := make(chan *FetchError, len(targets))
 
-	for _, url := range request.URLs {
-		go func(url string) {
-			resp, err := f.fetchURL(request, url)
-			if err != nil {
-				errc <- &FetchError{URL: url, Error: err}
-				return
+	for i := 0; i < f.workers(request); i++ {
+		go func() {
+			for t := range targetc {
+				start := time.Now()
+				resp, err := f.fetchTarget(c, request, t, states[stateKey(t)])
+				if err != nil {
+					errc <- &FetchError{URL: t.URL, Target: t, Error: err,
+						Permanent: f.permanent(err), Latency: time.Since(start)}
+					continue
+				}
+				resp.Latency = time.Since(start)
+				resc <- resp
 			}
-			resc <- resp
-		}(url)
+		}()
 	}
 
+	go func() {
+		defer close(targetc)
+		for _, t := range targets {
+			select {
+			case targetc <- t:
+			case <-c.Done():
+				return
+			}
+		}
+	}()
+
 	result = make([]*FetchResponse, 0)
 	errors = make([]*FetchError, 0)
 
-	for i := 0; i < len(request.URLs); i++ {
+	pending := make(map[*Target]bool)
+	for _, t := range targets {
+		pending[t] = true
+	}
+	for len(pending) > 0 {
 		select {
 		case res := <-resc:
+			delete(pending, res.Target)
 			result = append(result, res)
 		case err := <-errc:
+			delete(pending, err.Target)
 			errors = append(errors, err)
+		case <-c.Done():
+			errors = append(errors, f.timedOut(targets, pending)...)
+			return
 		}
 	}
 	return
 }
 
-func (f *Fetcher) Retry(request *FetchRequest, errors []*FetchError) error {
-	retryRequest := FetchRequest{Topic: request.Topic}
-	retryRequest.URLs = make([]string, len(errors))
-	for i := range errors {
-		retryRequest.URLs[i] = errors[i].URL
-	}
-	content, err := json.Marshal(&retryRequest)
+func (f *Fetcher) enqueue(request *FetchRequest, next *FetchRequest, delay time.Duration) error {
+	content, err := json.Marshal(next)
 	if err != nil {
 		return err
 	}
@@ -116,6 +376,7 @@ func (f *Fetcher) Retry(request *FetchRequest, errors []*FetchError) error {
 		Path:    request.Request.URL.Path,
 		Payload: content,
 		Method:  "POST",
+		Delay:   delay,
 	}
 	if _, err := taskqueue.Add(request.Context,
 		t, request.Request.Header.Get("X-AppEngine-QueueName")); err != nil {
@@ -124,80 +385,178 @@ func (f *Fetcher) Retry(request *FetchRequest, errors []*FetchError) error {
 	return nil
 }
 
-func (f *Fetcher) Publish(request *FetchRequest, entries []*FetchResponse) (err error) {
-	client, err := google.DefaultClient(request.Context, pubsub.CloudPlatformScope)
-	if err != nil {
-		return
-	}
-	service, err := pubsub.New(client)
-	if err != nil {
-		return
+// Retry enqueues the failed URLs again. URLs that failed to publish to a
+// single topic are only retried for that topic. Dead letters that can't be
+// written are only logged: failing the task would run the last attempt
+// again and again.
+func (f *Fetcher) Retry(request *FetchRequest, errors []*FetchError) error {
+	attempt := request.Attempt + 1
+	if attempt >= f.maxAttempts() {
+		if err := f.DeadLetter(request, errors, attempt); err != nil {
+			log.Errorf(request.Context, "fetcher: dead-lettering: %v", err)
+		}
+		return nil
 	}
-	messages := make([]*pubsub.PubsubMessage, len(entries))
-	for i := range entries {
-		messages[i] = &pubsub.PubsubMessage{
-			Data: base64.StdEncoding.EncodeToString(entries[i].Content),
+
+	var topics []string
+	byTopic := make(map[string][]*FetchError)
+	for _, e := range errors {
+		if _, ok := byTopic[e.Topic]; !ok {
+			topics = append(topics, e.Topic)
 		}
+		byTopic[e.Topic] = append(byTopic[e.Topic], e)
 	}
-	pr := pubsub.PublishRequest{
-		Messages: messages,
+
+	for _, topic := range topics {
+		retryRequest := FetchRequest{Topic: request.Topic, Topics: request.Topics,
+			Sink: request.Sink, Workers: request.Workers, Transform: request.Transform,
+			Crawl: request.Crawl, Attempt: attempt}
+		if topic != "" {
+			retryRequest.Topic, retryRequest.Topics = topic, nil
+		}
+		for _, e := range byTopic[topic] {
+			retryRequest.URLs = append(retryRequest.URLs, *e.Target)
+		}
+		if err := f.enqueue(request, &retryRequest, f.backoff(attempt)); err != nil {
+			return err
+		}
 	}
-	var topic string
-	if request.Topic != "" {
-		topic = request.Topic
-	} else {
-		topic = f.Topic
+	return nil
+}
+
+// googleClient returns the client authorized for the Google APIs.
+func (f *Fetcher) googleClient(c context.Context, scope ...string) (*http.Client, error) {
+	if f.apiClient != nil {
+		return f.apiClient(c, scope...)
 	}
-	if topic == "" {
-		return fmt.Errorf("fetcher: topic is empty")
+	return google.DefaultClient(c, scope...)
+}
+
+func (f *Fetcher) pubsubService(c context.Context) (*pubsub.Service, error) {
+	client, err := f.googleClient(c, pubsub.CloudPlatformScope)
+	if err != nil {
+		return nil, err
 	}
+	return pubsub.New(client)
+}
 
-	full := fmt.Sprintf("projects/%s/topics/%s", request.AppID(), topic)
-	_, err = service.Projects.Topics.Publish(full, &pr).Do()
+// Publish writes entries to the sink of request. Entries that failed are
+// returned as errors, err is only set when nothing could be written at all.
+func (f *Fetcher) Publish(request *FetchRequest, entries []*FetchResponse) (errors []*FetchError, err error) {
+	sink, err := f.sink(request)
 	if err != nil {
 		return
 	}
-	return
+	return sink.Write(f, request, entries)
 }
 
+// ServeHTTP executes a FetchRequest task. It answers with a FetchResult if
+// the task is done, even if some URLs failed, and with an ErrorResponse
+// otherwise.
 func (f *Fetcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
 	c := appengine.NewContext(r)
 	request := FetchRequest{Context: c, Request: r}
 
-	// Decode request
+	// The execution and metrics are recorded whatever the exit, with the
+	// outcomes reached so far
+	var (
+		result, succeeded, unchanged, duplicates []*FetchResponse
+		errors, skipped, dropped                 []*FetchError
+		codes                                    map[string]int
+		metrics                                  *fetchMetrics
+		runErr                                   error
+	)
+	stat := func() FetchStat {
+		return FetchStat{Total: len(request.URLs), Success: len(succeeded), Fail: len(errors),
+			Skipped: len(skipped), Unchanged: len(unchanged),
+			Duplicate: len(duplicates), Dropped: len(dropped), StatusCodes: codes}
+	}
+	defer func() {
+		s := stat()
+		f.recordExecution(&request, &s, started, runErr)
+		if metrics != nil {
+			f.writeMetrics(&request, metrics, &s)
+		}
+	}()
+	fail := func(status int, err error) {
+		runErr = err
+		writeError(w, status, err)
+	}
+
+	// Decode request, malformed tasks are answered with 400 so that they
+	// aren't retried
 	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&request)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := decoder.Decode(&request); err != nil {
+		fail(http.StatusBadRequest, fmt.Errorf("fetcher: decoding request: %v", err))
+		return
+	}
+	if err := f.validate(&request); err != nil {
+		fail(http.StatusBadRequest, err)
 		return
 	}
 
 	// Do fetch
-	result, errors := f.Fetch(&request)
+	result, errors = f.Fetch(&request)
 
-	// Handle errors
-	if len(errors) > 0 {
-		if err := f.Retry(&request, errors); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	codes = countStatusCodes(result, errors)
+	f.recordHistory(&request, result, errors)
+	metrics = newFetchMetrics(result, errors)
+
+	// Follow links before transformers replace the content
+	if err := f.Crawl(&request, result); err != nil {
+		fail(http.StatusInternalServerError, err)
+		return
 	}
 
-	// Do publish
+	// URLs disallowed by robots.txt and permanent failures are not retried
+	errors, skipped = splitSkipped(errors)
+	errors, dropped = splitPermanent(errors)
+
+	// Do publish, unmodified and duplicate content is not published again
+	result, unchanged = splitUnchanged(result)
+	result, rejected := f.transform(&request, result)
+	dropped = append(dropped, rejected...)
+	result, duplicates = f.dedup(&request, result)
 	if len(result) > 0 {
-		err = f.Publish(&request, result)
+		// Nothing written at all is retried per URL like partial failures,
+		// rather than failing the task after the fetches are recorded
+		failed, err := f.Publish(&request, result)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Warningf(c, "fetcher: publishing: %v", err)
+			failed = failAll(result, err)
+		}
+		result = published(result, failed)
+		metrics.publishFailures = len(failed)
+		failed, rejected := splitPermanent(failed)
+		errors = append(errors, failed...)
+		dropped = append(dropped, rejected...)
+	}
+	succeeded = result
+	f.saveStates(&request, append(result, duplicates...))
+
+	// Handle errors
+	f.recordFailures(&request, append(append(result, duplicates...), unchanged...),
+		append(errors, dropped...))
+	for _, e := range dropped {
+		log.Warningf(c, "fetcher: dropping %s: %v", e.URL, e.Error)
+	}
+	if len(errors) > 0 {
+		metrics.retries = len(errors)
+		if err := f.Retry(&request, errors); err != nil {
+			fail(http.StatusInternalServerError, err)
 			return
 		}
 	}
 
 	// Write stat to response
-	s := FetchStat{Total: len(request.URLs), Success: len(result), Fail: len(errors)}
-	body, err := json.Marshal(s)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	res := FetchResult{FetchStat: stat()}
+	outcome := OutcomeRetried
+	if request.Attempt+1 >= f.maxAttempts() {
+		outcome = OutcomeDeadLettered
 	}
-	fmt.Fprint(w, body)
+	res.Errors = append(res.Errors, urlErrors(errors, outcome)...)
+	res.Errors = append(res.Errors, urlErrors(dropped, OutcomeDropped)...)
+	res.Errors = append(res.Errors, urlErrors(skipped, OutcomeSkipped)...)
+	writeJSON(w, http.StatusOK, &res)
 }
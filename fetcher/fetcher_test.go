@@ -0,0 +1,26 @@
+package fetcher
+
+import "testing"
+
+func TestWorkers(t *testing.T) {
+	urls := make([]Target, 100)
+	tests := []struct {
+		fetcher, request, urls int
+		want                   int
+	}{
+		{0, 0, 100, DefaultWorkers},
+		{20, 0, 100, 20},
+		{20, 5, 100, 5},
+		{20, 5000, 100, 20},
+		{0, 5000, 100, DefaultWorkers},
+		{20, 0, 3, 3},
+	}
+	for _, test := range tests {
+		f := &Fetcher{Workers: test.fetcher}
+		request := &FetchRequest{URLs: urls[:test.urls], Workers: test.request}
+		if got := f.workers(request); got != test.want {
+			t.Errorf("workers with %d, %d and %d urls = %d, want %d",
+				test.fetcher, test.request, test.urls, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package fetcher
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"net/http"
+	"time"
+)
+
+const DefaultHistoryTTL = 30 * 24 * time.Hour
+
+// FetchRecord is the outcome of a single fetch of a URL, kept in the
+// history until Expires. Looking up the history of a URL needs a
+// composite index on URLHash and -Fetched.
+type FetchRecord struct {
+	URL        string `datastore:",noindex"`
+	URLHash    string
+	Fetched    time.Time
+	StatusCode int           `datastore:",noindex"`
+	Latency    time.Duration `datastore:",noindex"`
+	Bytes      int           `datastore:",noindex"`
+	Error      string        `datastore:",noindex"`
+	Hash       string        `datastore:",noindex"`
+	Expires    time.Time
+}
+
+func (f *Fetcher) historyTTL() time.Duration {
+	if f.HistoryTTL > 0 {
+		return f.HistoryTTL
+	}
+	return DefaultHistoryTTL
+}
+
+// recordHistory adds the outcome of every URL of a Fetch to the history.
+func (f *Fetcher) recordHistory(request *FetchRequest, result []*FetchResponse, errors []*FetchError) {
+	if f.HistoryKind == "" {
+		return
+	}
+	now := time.Now()
+	expires := now.Add(f.historyTTL())
+	records := make([]*FetchRecord, 0, len(result)+len(errors))
+	for _, e := range result {
+		records = append(records, &FetchRecord{URL: e.URL, URLHash: urlHash(e.URL),
+			Fetched: e.Fetched, StatusCode: e.StatusCode, Latency: e.Latency,
+			Bytes: len(e.Content), Hash: e.Hash, Expires: expires})
+	}
+	for _, e := range errors {
+		r := &FetchRecord{URL: e.URL, URLHash: urlHash(e.URL), Fetched: now,
+			Latency: e.Latency, Error: e.Error.Error(), Expires: expires}
+		if se, ok := e.Error.(*StatusError); ok {
+			r.StatusCode = se.StatusCode
+		}
+		records = append(records, r)
+	}
+	c := request.Context
+	// A failed batch is logged and the others still written
+	eachBatch(len(records), func(start, end int) error {
+		batch := records[start:end]
+		keys := make([]*datastore.Key, len(batch))
+		for j := range batch {
+			keys[j] = datastore.NewIncompleteKey(c, f.HistoryKind, nil)
+		}
+		if _, err := datastore.PutMulti(c, keys, batch); err != nil {
+			log.Warningf(c, "fetcher: recording history: %v", err)
+		}
+		return nil
+	})
+}
+
+// History returns the latest limit records of url, newest first.
+func (f *Fetcher) History(c context.Context, url string, limit int) (records []*FetchRecord, err error) {
+	q := datastore.NewQuery(f.HistoryKind).Filter("URLHash =", urlHash(url)).
+		Order("-Fetched").Limit(limit)
+	_, err = q.GetAll(c, &records)
+	return
+}
+
+// HistoryRange returns up to limit records fetched from start until end,
+// newest first.
+func (f *Fetcher) HistoryRange(c context.Context, start, end time.Time, limit int) (records []*FetchRecord, err error) {
+	q := datastore.NewQuery(f.HistoryKind).Filter("Fetched >=", start).
+		Filter("Fetched <", end).Order("-Fetched").Limit(limit)
+	_, err = q.GetAll(c, &records)
+	return
+}
+
+// CleanupHistory deletes expired records, a bounded number per call.
+func (f *Fetcher) CleanupHistory(c context.Context) (CleanupResult, error) {
+	return deleteExpired(c, f.HistoryKind)
+}
+
+// HandleHistoryCleanup runs CleanupHistory, typically from cron, and
+// writes its CleanupResult, More telling that the next run has records
+// left to delete.
+func (f *Fetcher) HandleHistoryCleanup(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if f.HistoryKind == "" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("fetcher: history is disabled"))
+		return
+	}
+	result, err := f.CleanupHistory(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &result)
+}
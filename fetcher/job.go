@@ -0,0 +1,338 @@
+package fetcher
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+	"google.golang.org/appengine/urlfetch"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultJobKind = "FetcherJob"
+	// DefaultJobBatch is the number of URLs per enqueued job request
+	DefaultJobBatch = 100
+	// DefaultJobRetryDelay is the delay before a failed run is dispatched
+	// again
+	DefaultJobRetryDelay = 5 * time.Minute
+)
+
+// neverRun is the NextRun of disabled jobs, keeping them out of the due
+// jobs query.
+var neverRun = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Job run statuses
+const (
+	JobOK    = "ok"
+	JobError = "error"
+)
+
+// FetchJob is a recurring fetch, keyed by Name. Its URLs are the URLs
+// listed or those returned by Source, either as a JSON array or one per
+// line. A job with no Interval runs once and is disabled afterwards. A run
+// that fails to dispatch is retried after the RetryDelay of the dispatcher.
+type FetchJob struct {
+	Name     string        `datastore:"-"`
+	URLs     []string      `datastore:",noindex"`
+	Source   string        `datastore:",noindex"`
+	Interval time.Duration `datastore:",noindex"`
+	Topic    string        `datastore:",noindex"`
+	Topics   []string      `datastore:",noindex"`
+	Sink     string        `datastore:",noindex"`
+	// Options is a JSON FetchRequest supplying the other request fields,
+	// such as workers, transform and crawl
+	Options []byte `datastore:",noindex"`
+	// Path and Queue override those of the dispatcher
+	Path     string `datastore:",noindex"`
+	Queue    string `datastore:",noindex"`
+	Disabled bool   `datastore:",noindex"`
+	NextRun  time.Time
+
+	LastRun    time.Time `datastore:",noindex"`
+	LastStatus string    `datastore:",noindex"`
+	LastError  string    `datastore:",noindex"`
+	LastURLs   int       `datastore:",noindex"`
+}
+
+// JobDispatcher is the cron handler enqueueing the due FetchJobs of Kind
+// (DefaultJobKind if empty) as FetchRequest tasks to Path on Queue.
+type JobDispatcher struct {
+	Kind  string
+	Path  string
+	Queue string
+	// Batch bounds the URLs per task, DefaultJobBatch if zero
+	Batch int
+	// RetryDelay is the delay before retrying a failed run,
+	// DefaultJobRetryDelay if zero
+	RetryDelay time.Duration
+}
+
+// JobStat is written as the response of the dispatcher.
+type JobStat struct {
+	Due        int `json:"due"`
+	Dispatched int `json:"dispatched"`
+	Failed     int `json:"failed"`
+}
+
+func (d *JobDispatcher) kind() string {
+	if d.Kind != "" {
+		return d.Kind
+	}
+	return DefaultJobKind
+}
+
+func (d *JobDispatcher) retryDelay() time.Duration {
+	if d.RetryDelay > 0 {
+		return d.RetryDelay
+	}
+	return DefaultJobRetryDelay
+}
+
+func (d *JobDispatcher) key(c context.Context, name string) *datastore.Key {
+	return datastore.NewKey(c, d.kind(), name, 0, nil)
+}
+
+// SaveJob creates or replaces job. Disabled jobs are never due; enabling
+// one again needs a new NextRun.
+func (d *JobDispatcher) SaveJob(c context.Context, job *FetchJob) error {
+	if job.Name == "" {
+		return fmt.Errorf("fetcher: job name is empty")
+	}
+	if job.Disabled {
+		job.NextRun = neverRun
+	}
+	_, err := datastore.Put(c, d.key(c, job.Name), job)
+	return err
+}
+
+// Jobs returns all jobs ordered by name.
+func (d *JobDispatcher) Jobs(c context.Context) ([]*FetchJob, error) {
+	var jobs []*FetchJob
+	keys, err := datastore.NewQuery(d.kind()).GetAll(c, &jobs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range jobs {
+		jobs[i].Name = keys[i].StringID()
+	}
+	return jobs, nil
+}
+
+// claim advances the NextRun of the job named name if it is due, so that
+// concurrent dispatchers don't run it twice.
+func (d *JobDispatcher) claim(c context.Context, name string, now time.Time) (job *FetchJob, err error) {
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		job = &FetchJob{}
+		key := d.key(tc, name)
+		if err := datastore.Get(tc, key, job); err != nil {
+			return err
+		}
+		job.Name = name
+		if job.NextRun.After(now) {
+			job = nil
+			return nil
+		}
+		due := job.advance(now)
+		_, err := datastore.Put(tc, key, job)
+		if !due {
+			job = nil
+		}
+		return err
+	}, nil)
+	return
+}
+
+// advance moves NextRun past now and reports whether the job is due. A
+// one-shot job is disabled, and a disabled job is moved out of the due
+// jobs.
+func (job *FetchJob) advance(now time.Time) bool {
+	if job.Disabled {
+		job.NextRun = neverRun
+		return false
+	}
+	if job.Interval > 0 {
+		job.NextRun = job.NextRun.Add(job.Interval)
+		if !job.NextRun.After(now) {
+			job.NextRun = now.Add(job.Interval)
+		}
+	} else {
+		job.Disabled = true
+		job.NextRun = neverRun
+	}
+	job.LastRun = now
+	return true
+}
+
+// retry gives back a run that failed to dispatch, due again at retry
+// unless the job is due sooner. The tasks enqueued before the failure are
+// enqueued again.
+func (job *FetchJob) retry(retry time.Time) {
+	if job.Interval == 0 {
+		job.Disabled = false
+	}
+	if retry.Before(job.NextRun) {
+		job.NextRun = retry
+	}
+}
+
+// record stores the outcome of the last run of job, scheduling a retry if
+// it failed.
+func (d *JobDispatcher) record(c context.Context, job *FetchJob, urls int, runErr error) error {
+	retry := time.Now().Add(d.retryDelay())
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		stored := &FetchJob{}
+		key := d.key(tc, job.Name)
+		if err := datastore.Get(tc, key, stored); err != nil {
+			return err
+		}
+		stored.LastStatus, stored.LastError, stored.LastURLs = JobOK, "", urls
+		if runErr != nil {
+			stored.LastStatus, stored.LastError = JobError, runErr.Error()
+			stored.retry(retry)
+		}
+		_, err := datastore.Put(tc, key, stored)
+		return err
+	}, nil)
+}
+
+// sourceURLs reads the URL list of a job from its Source.
+func sourceURLs(c context.Context, source string) ([]string, error) {
+	resp, err := urlfetch.Client(c).Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &StatusError{URL: source, StatusCode: resp.StatusCode}
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var urls []string
+	if trimmed := bytes.TrimSpace(content); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &urls); err != nil {
+			return nil, fmt.Errorf("fetcher: decoding %s: %v", source, err)
+		}
+		return urls, nil
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			urls = append(urls, line)
+		}
+	}
+	return urls, scanner.Err()
+}
+
+func addTask(c context.Context, request *FetchRequest, path, queue string) error {
+	content, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	t := &taskqueue.Task{Path: path, Payload: content, Method: "POST"}
+	_, err = taskqueue.Add(c, t, queue)
+	return err
+}
+
+// Dispatch enqueues the FetchRequest tasks of job and returns the number
+// of URLs enqueued.
+func (d *JobDispatcher) Dispatch(c context.Context, job *FetchJob) (int, error) {
+	urls := job.URLs
+	if job.Source != "" {
+		var err error
+		if urls, err = sourceURLs(c, job.Source); err != nil {
+			return 0, err
+		}
+	}
+	var template FetchRequest
+	if len(job.Options) > 0 {
+		if err := json.Unmarshal(job.Options, &template); err != nil {
+			return 0, fmt.Errorf("fetcher: decoding options of job %s: %v", job.Name, err)
+		}
+	}
+	if job.Topic != "" || len(job.Topics) > 0 {
+		template.Topic, template.Topics = job.Topic, job.Topics
+	}
+	if job.Sink != "" {
+		template.Sink = job.Sink
+	}
+	// The seed tasks of a run share one crawl
+	if template.Crawl != nil && template.Crawl.ID == "" {
+		template.Crawl.ID = urlHash(job.Name + "\n" + job.LastRun.UTC().Format(time.RFC3339Nano))
+	}
+	path, queue := d.Path, d.Queue
+	if job.Path != "" {
+		path = job.Path
+	}
+	if job.Queue != "" {
+		queue = job.Queue
+	}
+	if path == "" {
+		return 0, fmt.Errorf("fetcher: job %s has no path", job.Name)
+	}
+
+	batch := d.Batch
+	if batch <= 0 {
+		batch = DefaultJobBatch
+	}
+	for i := 0; i < len(urls); i += batch {
+		chunk := urls[i:]
+		if len(chunk) > batch {
+			chunk = chunk[:batch]
+		}
+		request := template
+		request.URLs = Targets(chunk...)
+		if err := addTask(c, &request, path, queue); err != nil {
+			return i, err
+		}
+	}
+	return len(urls), nil
+}
+
+func (d *JobDispatcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	now := time.Now()
+
+	keys, err := datastore.NewQuery(d.kind()).Filter("NextRun <=", now).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var s JobStat
+	for _, key := range keys {
+		job, err := d.claim(c, key.StringID(), now)
+		if err != nil {
+			log.Errorf(c, "fetcher: claiming job %s: %v", key.StringID(), err)
+			s.Failed++
+			continue
+		}
+		if job == nil {
+			continue
+		}
+		s.Due++
+		urls, err := d.Dispatch(c, job)
+		if err != nil {
+			log.Errorf(c, "fetcher: dispatching job %s: %v", job.Name, err)
+			s.Failed++
+		} else {
+			s.Dispatched++
+		}
+		if err := d.record(c, job, urls, err); err != nil {
+			log.Warningf(c, "fetcher: recording job %s: %v", job.Name, err)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, &s)
+}
@@ -0,0 +1,56 @@
+package fetcher
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobAdvance(t *testing.T) {
+	now := testTime
+	tests := []struct {
+		name     string
+		job      FetchJob
+		due      bool
+		nextRun  time.Time
+		disabled bool
+	}{
+		{"recurring", FetchJob{Interval: time.Hour, NextRun: now.Add(-time.Minute)},
+			true, now.Add(time.Hour - time.Minute), false},
+		{"recurring late", FetchJob{Interval: time.Hour, NextRun: now.Add(-3 * time.Hour)},
+			true, now.Add(time.Hour), false},
+		{"one-shot", FetchJob{NextRun: now.Add(-time.Minute)}, true, neverRun, true},
+		{"disabled", FetchJob{Interval: time.Hour, NextRun: now.Add(-time.Minute), Disabled: true},
+			false, neverRun, true},
+	}
+	for _, test := range tests {
+		job := test.job
+		due := job.advance(now)
+		if due != test.due || !job.NextRun.Equal(test.nextRun) || job.Disabled != test.disabled {
+			t.Errorf("%s: advance = %v, next run %v, disabled %v, want %v, %v, %v", test.name,
+				due, job.NextRun, job.Disabled, test.due, test.nextRun, test.disabled)
+		}
+	}
+}
+
+func TestJobRetry(t *testing.T) {
+	now := testTime
+	retry := now.Add(5 * time.Minute)
+	tests := []struct {
+		name    string
+		job     FetchJob
+		nextRun time.Time
+	}{
+		{"one-shot", FetchJob{NextRun: now.Add(-time.Minute)}, retry},
+		{"hourly", FetchJob{Interval: time.Hour, NextRun: now.Add(-time.Minute)}, retry},
+		{"frequent", FetchJob{Interval: time.Minute, NextRun: now.Add(-time.Minute)}, now.Add(time.Minute)},
+	}
+	for _, test := range tests {
+		job := test.job
+		job.advance(now)
+		job.retry(retry)
+		if job.Disabled || !job.NextRun.Equal(test.nextRun) {
+			t.Errorf("%s: retry = next run %v, disabled %v, want %v and enabled", test.name,
+				job.NextRun, job.Disabled, test.nextRun)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package fetcher
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"google.golang.org/api/pubsub/v1beta2"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// PubsubMaxAttributeSize is the Pub/Sub limit on the bytes of an attribute
+// value.
+const PubsubMaxAttributeSize = 1024
+
+type MessageFormat int
+
+const (
+	// FormatContent publishes the fetched content as message data
+	FormatContent MessageFormat = iota
+	// FormatEnvelope publishes an Envelope encoded as JSON
+	FormatEnvelope
+)
+
+// Envelope wraps the fetched content with the metadata also carried by the
+// message attributes.
+type Envelope struct {
+	URL         string    `json:"url"`
+	FinalURL    string    `json:"final_url"`
+	Redirects   []string  `json:"redirects,omitempty"`
+	StatusCode  int       `json:"status_code"`
+	ContentType string    `json:"content_type"`
+	Charset     string    `json:"charset,omitempty"`
+	Fetched     time.Time `json:"fetched_at"`
+	Hash        string    `json:"content_hash"`
+	Truncated   bool      `json:"truncated,omitempty"`
+	Size        int       `json:"content_length"`
+	StorageURL  string    `json:"storage_url,omitempty"`
+	Content     []byte    `json:"content,omitempty"`
+}
+
+// attributes returns the message attributes of e. Values over
+// PubsubMaxAttributeSize, such as long URLs or redirect chains, are omitted
+// and their names listed in the "omitted" attribute; the envelope keeps
+// them whole.
+// truncateAttribute cuts v to PubsubMaxAttributeSize bytes, on a UTF-8
+// boundary.
+func truncateAttribute(v string) string {
+	if len(v) <= PubsubMaxAttributeSize {
+		return v
+	}
+	v = v[:PubsubMaxAttributeSize]
+	for len(v) > 0 && !utf8.ValidString(v) {
+		v = v[:len(v)-1]
+	}
+	return v
+}
+
+func attributes(e *FetchResponse) map[string]string {
+	attrs := map[string]string{
+		"url":          e.URL,
+		"final_url":    e.FinalURL,
+		"status_code":  strconv.Itoa(e.StatusCode),
+		"content_type": e.ContentType,
+		"fetched_at":   e.Fetched.UTC().Format(time.RFC3339Nano),
+		"content_hash": e.Hash,
+	}
+	if len(e.Redirects) > 0 {
+		attrs["redirects"] = strings.Join(e.Redirects, " ")
+	}
+	if e.Charset != "" {
+		attrs["charset"] = e.Charset
+	}
+	if e.Truncated {
+		attrs["truncated"] = "true"
+	}
+	if e.StorageURL != "" {
+		attrs["storage_url"] = e.StorageURL
+		attrs["content_length"] = strconv.Itoa(len(e.Content))
+	}
+	var omitted []string
+	for k, v := range attrs {
+		if len(v) > PubsubMaxAttributeSize {
+			omitted = append(omitted, k)
+			delete(attrs, k)
+		}
+	}
+	if len(omitted) > 0 {
+		sort.Strings(omitted)
+		attrs["omitted"] = strings.Join(omitted, ",")
+	}
+	return attrs
+}
+
+func envelope(e *FetchResponse) *Envelope {
+	content := e.Content
+	if e.StorageURL != "" {
+		content = nil
+	}
+	return &Envelope{
+		URL:         e.URL,
+		FinalURL:    e.FinalURL,
+		Redirects:   e.Redirects,
+		StatusCode:  e.StatusCode,
+		ContentType: e.ContentType,
+		Charset:     e.Charset,
+		Fetched:     e.Fetched,
+		Hash:        e.Hash,
+		Truncated:   e.Truncated,
+		Size:        len(e.Content),
+		StorageURL:  e.StorageURL,
+		Content:     content,
+	}
+}
+
+// message builds the Pub/Sub message for e. Offloaded content is replaced
+// by its gs:// reference.
+func (f *Fetcher) message(e *FetchResponse) (*pubsub.PubsubMessage, error) {
+	data := e.Content
+	if e.StorageURL != "" {
+		data = []byte(e.StorageURL)
+	}
+	if f.Format == FormatEnvelope {
+		var err error
+		data, err = json.Marshal(envelope(e))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &pubsub.PubsubMessage{
+		Attributes: attributes(e),
+		Data:       base64.StdEncoding.EncodeToString(data),
+	}, nil
+}
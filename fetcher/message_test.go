@@ -0,0 +1,59 @@
+package fetcher
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestAttributesOmitOversize(t *testing.T) {
+	long := "http://a/?" + strings.Repeat("x", PubsubMaxAttributeSize)
+	tests := []struct {
+		name      string
+		url       string
+		redirects []string
+		omitted   string
+	}{
+		{"short", "http://a/", []string{"http://b/"}, ""},
+		{"long url", long, nil, "final_url,url"},
+		{"long redirects", "http://a/", []string{long[:600], long[:600]}, "redirects"},
+		{"at limit", long[:PubsubMaxAttributeSize], nil, ""},
+	}
+	for _, test := range tests {
+		e := testEntry(test.url, "abc", testTime)
+		e.FinalURL, e.Redirects = test.url, test.redirects
+		attrs := attributes(e)
+		if attrs["omitted"] != test.omitted {
+			t.Errorf("%s: omitted = %q, want %q", test.name, attrs["omitted"], test.omitted)
+		}
+		for k, v := range attrs {
+			if len(v) > PubsubMaxAttributeSize {
+				t.Errorf("%s: attribute %s has %d bytes", test.name, k, len(v))
+			}
+		}
+		if test.omitted == "" && attrs["url"] != test.url {
+			t.Errorf("%s: url = %q, want %q", test.name, attrs["url"], test.url)
+		}
+		if attrs["content_hash"] != e.Hash {
+			t.Errorf("%s: content_hash missing", test.name)
+		}
+	}
+}
+
+func TestTruncateAttribute(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"short", 5},
+		{strings.Repeat("x", PubsubMaxAttributeSize+10), PubsubMaxAttributeSize},
+		// 3-byte runes don't end on the limit
+		{strings.Repeat("€", PubsubMaxAttributeSize), PubsubMaxAttributeSize / 3 * 3},
+	}
+	for _, test := range tests {
+		got := truncateAttribute(test.value)
+		if len(got) != test.want || !utf8.ValidString(got) || !strings.HasPrefix(test.value, got) {
+			t.Errorf("truncateAttribute of %d bytes = %d bytes, want %d", len(test.value), len(got), test.want)
+		}
+	}
+}
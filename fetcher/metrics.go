@@ -0,0 +1,263 @@
+package fetcher
+
+import (
+	"github.com/porter-io/appengine-toolkit/monitoringadmin"
+	"golang.org/x/net/context"
+	"google.golang.org/api/cloudmonitoring/v2beta2"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"sort"
+	"time"
+)
+
+const (
+	DefaultMetricPrefix = "fetcher"
+	customMetricDomain  = "custom.cloudmonitoring.googleapis.com/"
+)
+
+// DefaultMetricsInterval is the interval of the points written by an
+// instance.
+const DefaultMetricsInterval = time.Minute
+
+// maxLatencySamples bounds the latencies kept per interval
+const maxLatencySamples = 10000
+
+type metricDescriptor struct {
+	name        string
+	description string
+	metricType  string
+	valueType   string
+	label       string
+}
+
+// The Cloud Monitoring API has no distributions, latency is written as a
+// gauge per quantile instead. Every metric also has an instance label, so
+// that instances write separate time series.
+var metricDescriptors = []metricDescriptor{
+	{"fetches", "URLs handled by outcome", "delta", "int64", "outcome"},
+	{"latency", "Fetch latency quantiles in milliseconds", "gauge", "double", "quantile"},
+	{"bytes", "Bytes fetched", "delta", "int64", ""},
+	{"publish_failures", "Entries that failed to publish", "delta", "int64", ""},
+	{"retries", "URLs handed to Retry", "delta", "int64", ""},
+}
+
+// fetchMetrics collects the values of a single request.
+type fetchMetrics struct {
+	latencies       []float64
+	bytes           int64
+	publishFailures int
+	retries         int
+}
+
+func newFetchMetrics(result []*FetchResponse, errors []*FetchError) *fetchMetrics {
+	m := &fetchMetrics{}
+	for _, e := range result {
+		m.latencies = append(m.latencies, e.Latency.Seconds()*1000)
+		m.bytes += int64(len(e.Content))
+	}
+	for _, e := range errors {
+		if e.Latency > 0 {
+			m.latencies = append(m.latencies, e.Latency.Seconds()*1000)
+		}
+	}
+	return m
+}
+
+// metricsWindow accumulates the metrics of the requests served by an
+// instance from start until it is written. Windows follow each other, so
+// that the points of an instance never overlap.
+type metricsWindow struct {
+	start           time.Time
+	outcomes        map[string]int64
+	latencies       []float64
+	bytes           int64
+	publishFailures int64
+	retries         int64
+}
+
+func newMetricsWindow(start time.Time) *metricsWindow {
+	return &metricsWindow{start: start, outcomes: make(map[string]int64)}
+}
+
+func (w *metricsWindow) add(m *fetchMetrics, s *FetchStat) {
+	for outcome, n := range map[string]int{
+		"success": s.Success, "fail": s.Fail, "skipped": s.Skipped,
+		"unchanged": s.Unchanged, "duplicate": s.Duplicate, "dropped": s.Dropped,
+	} {
+		w.outcomes[outcome] += int64(n)
+	}
+	w.bytes += m.bytes
+	w.publishFailures += int64(m.publishFailures)
+	w.retries += int64(m.retries)
+	for _, l := range m.latencies {
+		if len(w.latencies) == maxLatencySamples {
+			break
+		}
+		w.latencies = append(w.latencies, l)
+	}
+}
+
+func (f *Fetcher) metricsInterval() time.Duration {
+	if f.MetricsInterval > 0 {
+		return f.MetricsInterval
+	}
+	return DefaultMetricsInterval
+}
+
+// collectMetrics adds the metrics of a request to the window of the
+// instance. Once the window spans MetricsInterval, it is returned to be
+// written and the next one starts at now.
+func (f *Fetcher) collectMetrics(m *fetchMetrics, s *FetchStat, now time.Time) *metricsWindow {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.metricsWindow == nil {
+		f.metricsWindow = newMetricsWindow(now)
+	}
+	f.metricsWindow.add(m, s)
+	if now.Sub(f.metricsWindow.start) < f.metricsInterval() {
+		return nil
+	}
+	w := f.metricsWindow
+	f.metricsWindow = newMetricsWindow(now)
+	return w
+}
+func quantile(sorted []float64, q float64) float64 {
+	return sorted[int(q*float64(len(sorted)-1)+0.5)]
+}
+
+func (f *Fetcher) metricName(name string) string {
+	prefix := f.MetricPrefix
+	if prefix == "" {
+		prefix = DefaultMetricPrefix
+	}
+	return customMetricDomain + prefix + "/" + name
+}
+
+// createMetrics creates the metric descriptors missing from the project,
+// once per instance.
+func (f *Fetcher) createMetrics(c context.Context, service *cloudmonitoring.Service) error {
+	f.mu.Lock()
+	created := f.metricsCreated
+	f.mu.Unlock()
+	if created {
+		return nil
+	}
+	project := appengine.AppID(c)
+	existing := make(map[string]bool)
+	for token := ""; ; {
+		r := cloudmonitoring.ListMetricDescriptorsRequest{Kind: "cloudmonitoring#listMetricDescriptorsRequest"}
+		resp, err := service.MetricDescriptors.List(project, &r).PageToken(token).Do()
+		if err != nil {
+			return err
+		}
+		for _, m := range resp.Metrics {
+			existing[m.Name] = true
+		}
+		if token = resp.NextPageToken; token == "" {
+			break
+		}
+	}
+	for _, d := range metricDescriptors {
+		name := f.metricName(d.name)
+		if existing[name] {
+			continue
+		}
+		m := cloudmonitoring.MetricDescriptor{
+			Name:        name,
+			Description: d.description,
+			TypeDescriptor: &cloudmonitoring.MetricDescriptorTypeDescriptor{
+				MetricType: d.metricType,
+				ValueType:  d.valueType,
+			},
+		}
+		m.Labels = []*cloudmonitoring.MetricDescriptorLabelDescriptor{
+			{Key: customMetricDomain + "instance"},
+		}
+		if d.label != "" {
+			m.Labels = append(m.Labels,
+				&cloudmonitoring.MetricDescriptorLabelDescriptor{Key: customMetricDomain + d.label})
+		}
+		if _, err := service.MetricDescriptors.Create(project, &m).Do(); err != nil {
+			return err
+		}
+	}
+	f.mu.Lock()
+	f.metricsCreated = true
+	f.mu.Unlock()
+	return nil
+}
+
+// writeMetrics adds the metrics of a request to the window of the
+// instance and writes the window once it spans MetricsInterval, logging
+// failures.
+func (f *Fetcher) writeMetrics(request *FetchRequest, m *fetchMetrics, s *FetchStat) {
+	if !f.Metrics {
+		return
+	}
+	end := time.Now()
+	w := f.collectMetrics(m, s, end)
+	if w == nil {
+		return
+	}
+	c := request.Context
+	service, err := monitoringadmin.NewMonitoringService(c)
+	if err == nil {
+		err = f.createMetrics(c, service)
+	}
+	if err != nil {
+		log.Warningf(c, "fetcher: creating metrics: %v", err)
+		return
+	}
+	wr := cloudmonitoring.WriteTimeseriesRequest{
+		CommonLabels: map[string]string{customMetricDomain + "instance": appengine.InstanceID()},
+		Timeseries:   f.metricPoints(w, end),
+	}
+	if _, err := service.Timeseries.Write(appengine.AppID(c), &wr).Do(); err != nil {
+		log.Warningf(c, "fetcher: writing metrics: %v", err)
+	}
+}
+
+// metricPoints returns the points of w, deltas over the window and
+// latency quantiles at its end.
+func (f *Fetcher) metricPoints(w *metricsWindow, end time.Time) (points []*cloudmonitoring.TimeseriesPoint) {
+	startTime := w.start.UTC().Format(time.RFC3339Nano)
+	endTime := end.UTC().Format(time.RFC3339Nano)
+	delta := func(name, label, value string, n int64) {
+		desc := &cloudmonitoring.TimeseriesDescriptor{Metric: f.metricName(name)}
+		if label != "" {
+			desc.Labels = map[string]string{customMetricDomain + label: value}
+		}
+		points = append(points, &cloudmonitoring.TimeseriesPoint{
+			Point:          &cloudmonitoring.Point{Start: startTime, End: endTime, Int64Value: &n},
+			TimeseriesDesc: desc,
+		})
+	}
+	outcomes := make([]string, 0, len(w.outcomes))
+	for outcome := range w.outcomes {
+		outcomes = append(outcomes, outcome)
+	}
+	sort.Strings(outcomes)
+	for _, outcome := range outcomes {
+		delta("fetches", "outcome", outcome, w.outcomes[outcome])
+	}
+	delta("bytes", "", "", w.bytes)
+	delta("publish_failures", "", "", w.publishFailures)
+	delta("retries", "", "", w.retries)
+	if len(w.latencies) > 0 {
+		sort.Float64s(w.latencies)
+		for _, q := range []struct {
+			label string
+			value float64
+		}{{"p50", 0.5}, {"p95", 0.95}, {"p99", 0.99}, {"max", 1}} {
+			v := quantile(w.latencies, q.value)
+			points = append(points, &cloudmonitoring.TimeseriesPoint{
+				Point: &cloudmonitoring.Point{Start: endTime, End: endTime, DoubleValue: &v},
+				TimeseriesDesc: &cloudmonitoring.TimeseriesDescriptor{
+					Metric: f.metricName("latency"),
+					Labels: map[string]string{customMetricDomain + "quantile": q.label},
+				},
+			})
+		}
+	}
+	return
+}
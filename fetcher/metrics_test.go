@@ -0,0 +1,61 @@
+package fetcher
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCollectMetrics(t *testing.T) {
+	f := &Fetcher{MetricsInterval: time.Minute}
+	m := &fetchMetrics{latencies: []float64{10, 20}, bytes: 100, retries: 1}
+	s := &FetchStat{Success: 2, Fail: 1}
+
+	var windows []*metricsWindow
+	var ends []time.Time
+	for _, offset := range []time.Duration{0, 30 * time.Second, 61 * time.Second, 90 * time.Second, 150 * time.Second} {
+		now := testTime.Add(offset)
+		if w := f.collectMetrics(m, s, now); w != nil {
+			windows, ends = append(windows, w), append(ends, now)
+		}
+	}
+	if len(windows) != 2 {
+		t.Fatalf("collectMetrics wrote %d windows, want 2", len(windows))
+	}
+	if windows[0].outcomes["success"] != 6 || windows[0].bytes != 300 || len(windows[0].latencies) != 6 {
+		t.Errorf("first window = %+v, want 3 requests", windows[0])
+	}
+	if windows[1].outcomes["fail"] != 2 || windows[1].retries != 2 {
+		t.Errorf("second window = %+v, want 2 requests", windows[1])
+	}
+	// Consecutive windows don't overlap
+	if !windows[1].start.Equal(ends[0]) || !ends[1].After(windows[1].start) {
+		t.Errorf("windows %v-%v and %v-%v overlap", windows[0].start, ends[0], windows[1].start, ends[1])
+	}
+}
+
+func TestMetricsWindowLatencySamples(t *testing.T) {
+	w := newMetricsWindow(testTime)
+	m := &fetchMetrics{latencies: make([]float64, maxLatencySamples/2+1)}
+	for i := 0; i < 3; i++ {
+		w.add(m, &FetchStat{})
+	}
+	if len(w.latencies) != maxLatencySamples {
+		t.Errorf("window kept %d latencies, want %d", len(w.latencies), maxLatencySamples)
+	}
+}
+
+func TestMetricPoints(t *testing.T) {
+	f := &Fetcher{}
+	w := newMetricsWindow(testTime)
+	w.add(&fetchMetrics{latencies: []float64{30, 10, 20}}, &FetchStat{Success: 3})
+	end := testTime.Add(time.Minute)
+	for _, p := range f.metricPoints(w, end) {
+		if p.Point.Int64Value != nil && p.Point.Start != testTime.Format(time.RFC3339Nano) {
+			t.Errorf("delta %s starts at %s", p.TimeseriesDesc.Metric, p.Point.Start)
+		}
+		if p.Point.DoubleValue != nil && p.TimeseriesDesc.Labels[customMetricDomain+"quantile"] == "max" &&
+			*p.Point.DoubleValue != 30 {
+			t.Errorf("max latency = %v, want 30", *p.Point.DoubleValue)
+		}
+	}
+}
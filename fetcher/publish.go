@@ -0,0 +1,164 @@
+package fetcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/api/pubsub/v1beta2"
+	"google.golang.org/appengine"
+	"strings"
+)
+
+// Pub/Sub limits of a single publish request
+const (
+	PubsubMaxBatchMessages = 1000
+	PubsubMaxBatchSize     = 10 << 20
+)
+
+type batch struct {
+	entries  []*FetchResponse
+	messages []*pubsub.PubsubMessage
+	size     int
+}
+
+// publishRequestOverhead is the size of an empty publish request body,
+// {"messages":[]} and the newline of the JSON encoder.
+const publishRequestOverhead = len(`{"messages":[]}`) + 1
+
+// encodedSize is the size of m marshalled in a publish request, escaping
+// and separating comma included. Messages and batches are both measured
+// this way, so that a message within PubsubMaxMessageSize also fits in a
+// batch of its own.
+func encodedSize(m *pubsub.PubsubMessage) int {
+	b, err := json.Marshal(m)
+	if err != nil {
+		// Can't be marshalled, so it is dropped as oversize
+		return PubsubMaxMessageSize + 1
+	}
+	return len(b) + 1
+}
+
+// addToBatches adds e and its message m to the last of batches, starting a
+// new batch when it would exceed the Pub/Sub request limits.
+func addToBatches(batches []*batch, e *FetchResponse, m *pubsub.PubsubMessage) []*batch {
+	size := encodedSize(m)
+	if n := len(batches); n == 0 || len(batches[n-1].messages) == PubsubMaxBatchMessages ||
+		publishRequestOverhead+batches[n-1].size+size > PubsubMaxBatchSize {
+		batches = append(batches, &batch{})
+	}
+	current := batches[len(batches)-1]
+	current.entries = append(current.entries, e)
+	current.messages = append(current.messages, m)
+	current.size += size
+	return batches
+}
+
+// batches splits entries into batches within the Pub/Sub request limits.
+func (f *Fetcher) batches(entries []*FetchResponse) (batches []*batch, errors []*FetchError) {
+	for _, e := range entries {
+		m, err := f.message(e)
+		if err != nil {
+			errors = append(errors, &FetchError{URL: e.URL, Target: e.Target,
+				Error: err, Permanent: true})
+			continue
+		}
+		batches = addToBatches(batches, e, m)
+	}
+	return
+}
+
+// fullTopic qualifies topic with the current project unless it already
+// starts with "projects/", leaving the validation of full names to Pub/Sub.
+func fullTopic(c context.Context, topic string) string {
+	if strings.HasPrefix(topic, "projects/") {
+		return topic
+	}
+	return fmt.Sprintf("projects/%s/topics/%s", appengine.AppID(c), topic)
+}
+
+// topics returns the destination topics of request, falling back to those
+// of f.
+func (f *Fetcher) topics(request *FetchRequest) []string {
+	var topics []string
+	if request.Topic != "" || len(request.Topics) > 0 {
+		topics = append(topics, request.Topics...)
+		if request.Topic != "" {
+			topics = append(topics, request.Topic)
+		}
+	} else {
+		topics = append(topics, f.Topics...)
+		if f.Topic != "" {
+			topics = append(topics, f.Topic)
+		}
+	}
+	seen := make(map[string]bool)
+	result := topics[:0]
+	for _, t := range topics {
+		if !seen[t] {
+			seen[t] = true
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+func publishBatch(c context.Context, service *pubsub.Service, topic string, messages []*pubsub.PubsubMessage) error {
+	pr := pubsub.PublishRequest{
+		Messages: messages,
+	}
+	_, err := service.Projects.Topics.Publish(fullTopic(c, topic), &pr).Do()
+	return err
+}
+
+// publishBatches publishes batches with up to PublishWorkers in parallel
+// and returns the entries of the failed ones.
+func (f *Fetcher) publishBatches(c context.Context, service *pubsub.Service, topic string, batches []*batch) (errors []*FetchError) {
+	workers := f.PublishWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	batchc := make(chan *batch)
+	errc := make(chan []*FetchError)
+	for i := 0; i < workers && i < len(batches); i++ {
+		go func() {
+			for b := range batchc {
+				var failed []*FetchError
+				if err := publishBatch(c, service, topic, b.messages); err != nil {
+					for _, e := range b.entries {
+						failed = append(failed, &FetchError{URL: e.URL, Target: e.Target,
+							Topic: topic, Error: fmt.Errorf("fetcher: publishing %s to %s: %v",
+								e.URL, topic, err)})
+					}
+				}
+				errc <- failed
+			}
+		}()
+	}
+	go func() {
+		for _, b := range batches {
+			batchc <- b
+		}
+		close(batchc)
+	}()
+	for range batches {
+		errors = append(errors, <-errc...)
+	}
+	return
+}
+
+// published removes the entries that failed to publish from entries.
+func published(entries []*FetchResponse, failed []*FetchError) (result []*FetchResponse) {
+	if len(failed) == 0 {
+		return entries
+	}
+	skip := make(map[*Target]bool)
+	for _, e := range failed {
+		skip[e.Target] = true
+	}
+	for _, e := range entries {
+		if !skip[e.Target] {
+			result = append(result, e)
+		}
+	}
+	return
+}
@@ -0,0 +1,115 @@
+package fetcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"google.golang.org/api/pubsub/v1beta2"
+	"strings"
+	"testing"
+)
+
+func TestOversizeFitsBatch(t *testing.T) {
+	f := &Fetcher{}
+	// 9 MB decoded, 12 MB base64 encoded
+	large := testEntry("http://a/large", "", testTime)
+	large.Content = bytes.Repeat([]byte("x"), 9<<20)
+	small := testEntry("http://a/small", "abc", testTime)
+
+	fit, oversize := f.splitOversize([]*FetchResponse{large, small})
+	if len(fit) != 1 || fit[0] != small || len(oversize) != 1 || !oversize[0].Permanent {
+		t.Fatalf("splitOversize = %d fit, %d oversize, want the large entry dropped", len(fit), len(oversize))
+	}
+
+	// Whatever splitOversize lets through fits in a batch
+	edge := testEntry("http://a/edge", "", testTime)
+	edge.Content = bytes.Repeat([]byte("x"), PubsubMaxBatchSize/4*3-1024)
+	fit, _ = f.splitOversize([]*FetchResponse{edge})
+	if len(fit) != 1 {
+		t.Fatalf("splitOversize dropped an entry within the limit")
+	}
+	batches, errors := f.batches(fit)
+	if len(errors) > 0 || len(batches) != 1 {
+		t.Fatalf("batches = %d batches, %d errors, want a single batch", len(batches), len(errors))
+	}
+	if size := publishRequestSize(t, batches[0]); size > PubsubMaxBatchSize {
+		t.Errorf("publish request of %d bytes exceeds the limit", size)
+	}
+}
+
+// publishRequestSize is the size of the body publishing b.
+func publishRequestSize(t *testing.T, b *batch) int {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(&pubsub.PublishRequest{Messages: b.messages}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Len()
+}
+
+func TestBatchesFitRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries int
+		content int
+		url     int
+	}{
+		{"long urls", 1000, 7 << 10, 230},
+		{"small", 1000, 100, 20},
+		{"large", 50, 1 << 20, 50},
+	}
+	for _, test := range tests {
+		f := &Fetcher{}
+		// & is escaped by encoding/json as \u0026
+		url := "http://a/?" + strings.Repeat("a&", test.url/2)
+		var entries []*FetchResponse
+		for i := 0; i < test.entries; i++ {
+			e := testEntry(url, "", testTime)
+			e.Content = bytes.Repeat([]byte("x"), test.content)
+			entries = append(entries, e)
+		}
+		batches, errors := f.batches(entries)
+		if len(errors) > 0 {
+			t.Fatalf("%s: %v", test.name, errors[0].Error)
+		}
+		for _, b := range batches {
+			if size := publishRequestSize(t, b); size > PubsubMaxBatchSize {
+				t.Errorf("%s: publish request of %d bytes exceeds the limit", test.name, size)
+			}
+		}
+	}
+}
+
+func TestBatches(t *testing.T) {
+	f := &Fetcher{}
+	var entries []*FetchResponse
+	for i := 0; i < PubsubMaxBatchMessages+1; i++ {
+		entries = append(entries, testEntry("http://a/", "x", testTime))
+	}
+	batches, _ := f.batches(entries)
+	if len(batches) != 2 || len(batches[0].messages) != PubsubMaxBatchMessages || len(batches[1].messages) != 1 {
+		t.Errorf("batches of %d messages split wrong", len(entries))
+	}
+}
+
+func TestFullTopicQualified(t *testing.T) {
+	topics := []string{
+		"projects/p/topics/t",
+		"projects/my-project/topics/fetch.results",
+		"projects/domain.com:project/topics/a~b%c+d",
+	}
+	for _, topic := range topics {
+		if got := fullTopic(nil, topic); got != topic {
+			t.Errorf("fullTopic(%q) = %q, want it unchanged", topic, got)
+		}
+	}
+}
+
+func TestAddToBatches(t *testing.T) {
+	var batches []*batch
+	m := &pubsub.PubsubMessage{Data: "eA=="}
+	for i := 0; i < PubsubMaxBatchMessages+500; i++ {
+		batches = addToBatches(batches, testEntry("http://a/", "x", testTime), m)
+	}
+	if len(batches) != 2 || len(batches[0].messages) != PubsubMaxBatchMessages || len(batches[1].entries) != 500 {
+		t.Errorf("addToBatches split %d messages wrong", PubsubMaxBatchMessages+500)
+	}
+}
@@ -0,0 +1,146 @@
+package fetcher
+
+import (
+	"golang.org/x/net/context"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket refilled at Rate requests per second and
+// holding at most Burst tokens. The zero RateLimit stands for
+// DefaultRateLimit, a negative Rate disables limiting.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+var (
+	DefaultRateLimit = RateLimit{Rate: 2, Burst: 2}
+	Unlimited        = RateLimit{Rate: -1}
+)
+
+type limiter struct {
+	mu     sync.Mutex
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes a token and returns how long the caller has to wait
+// before it may be used.
+func (l *limiter) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	burst := float64(l.limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	if l.last.IsZero() {
+		l.tokens = burst
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * l.limit.Rate
+		if l.tokens > burst {
+			l.tokens = burst
+		}
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.limit.Rate * float64(time.Second))
+}
+
+// slowDown lowers the limit to limit if that is stricter.
+func (l *limiter) slowDown(limit RateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit.Rate <= 0 || limit.Rate < l.limit.Rate {
+		l.limit = limit
+	}
+}
+
+func (l *limiter) wait(c context.Context) error {
+	l.mu.Lock()
+	unlimited := l.limit.Rate <= 0
+	l.mu.Unlock()
+	if unlimited {
+		return nil
+	}
+	d := l.reserve(time.Now())
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-c.Done():
+		return c.Err()
+	}
+}
+
+func hostOf(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Host)
+}
+
+func (f *Fetcher) rateLimit(host string) RateLimit {
+	l, ok := f.HostRateLimits[host]
+	if !ok {
+		l = f.RateLimit
+	}
+	if l.Rate == 0 {
+		return DefaultRateLimit
+	}
+	return l
+}
+
+func (f *Fetcher) limiter(host string) *limiter {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.limiters == nil {
+		f.limiters = make(map[string]*limiter)
+	}
+	l, ok := f.limiters[host]
+	if !ok {
+		l = &limiter{limit: f.rateLimit(host)}
+		f.limiters[host] = l
+	}
+	return l
+}
+
+// wait blocks until the host of rawurl may be fetched again.
+func (f *Fetcher) wait(c context.Context, rawurl string) error {
+	return f.limiter(hostOf(rawurl)).wait(c)
+}
+
+// interleave reorders targets round-robin by host, so that workers waiting on
+// one rate limited host don't starve the others.
+func interleave(targets []Target) []*Target {
+	var hosts []string
+	byHost := make(map[string][]*Target)
+	for i := range targets {
+		h := hostOf(targets[i].URL)
+		if _, ok := byHost[h]; !ok {
+			hosts = append(hosts, h)
+		}
+		byHost[h] = append(byHost[h], &targets[i])
+	}
+	result := make([]*Target, 0, len(targets))
+	for len(result) < len(targets) {
+		for _, h := range hosts {
+			if len(byHost[h]) > 0 {
+				result = append(result, byHost[h][0])
+				byHost[h] = byHost[h][1:]
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,90 @@
+package fetcher
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLimiterReserve(t *testing.T) {
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		limit RateLimit
+		at    []time.Duration
+		wait  []time.Duration
+	}{
+		{
+			limit: RateLimit{Rate: 2, Burst: 2},
+			at:    []time.Duration{0, 0, 0, time.Second},
+			wait:  []time.Duration{0, 0, 500 * time.Millisecond, 0},
+		},
+		{
+			limit: RateLimit{Rate: 1, Burst: 0},
+			at:    []time.Duration{0, 0, 0},
+			wait:  []time.Duration{0, time.Second, 2 * time.Second},
+		},
+		{
+			limit: RateLimit{Rate: 10, Burst: 1},
+			at:    []time.Duration{0, 50 * time.Millisecond, time.Second},
+			wait:  []time.Duration{0, 50 * time.Millisecond, 0},
+		},
+	}
+	for i, test := range tests {
+		l := &limiter{limit: test.limit}
+		for j, at := range test.at {
+			if got := l.reserve(start.Add(at)); got != test.wait[j] {
+				t.Errorf("%d: reserve #%d = %v, want %v", i, j, got, test.wait[j])
+			}
+		}
+	}
+}
+
+func TestRateLimitDefault(t *testing.T) {
+	limited := RateLimit{Rate: 5, Burst: 1}
+	tests := []struct {
+		fetcher *Fetcher
+		host    string
+		want    RateLimit
+	}{
+		{&Fetcher{}, "a.com", DefaultRateLimit},
+		{&Fetcher{RateLimit: Unlimited}, "a.com", Unlimited},
+		{&Fetcher{RateLimit: limited}, "a.com", limited},
+		{&Fetcher{HostRateLimits: map[string]RateLimit{"a.com": limited}}, "a.com", limited},
+		{&Fetcher{HostRateLimits: map[string]RateLimit{"a.com": limited}}, "b.com", DefaultRateLimit},
+		{&Fetcher{RateLimit: Unlimited, HostRateLimits: map[string]RateLimit{"a.com": {}}}, "a.com", DefaultRateLimit},
+	}
+	for i, test := range tests {
+		if got := test.fetcher.rateLimit(test.host); got != test.want {
+			t.Errorf("%d: rateLimit(%q) = %v, want %v", i, test.host, got, test.want)
+		}
+	}
+}
+
+func TestInterleave(t *testing.T) {
+	tests := []struct {
+		urls []string
+		want []string
+	}{
+		{nil, []string{}},
+		{
+			[]string{"http://a/1", "http://a/2", "http://a/3", "http://b/1", "http://c/1", "http://b/2"},
+			[]string{"http://a/1", "http://b/1", "http://c/1", "http://a/2", "http://b/2", "http://a/3"},
+		},
+		{
+			[]string{"http://A/1", "http://a/2"},
+			[]string{"http://A/1", "http://a/2"},
+		},
+	}
+	for i, test := range tests {
+		var got []string
+		for _, target := range interleave(Targets(test.urls...)) {
+			got = append(got, target.URL)
+		}
+		if got == nil {
+			got = []string{}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%d: interleave = %v, want %v", i, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package fetcher
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/urlfetch"
+	"net/http"
+	"net/url"
+)
+
+const DefaultMaxRedirects = 10
+
+type RedirectMode int
+
+const (
+	// RedirectFollow follows redirects up to MaxHops
+	RedirectFollow RedirectMode = iota
+	// RedirectNone returns redirect responses as they are, which
+	// StatusPolicy treats as permanent failures unless told otherwise
+	RedirectNone
+	// RedirectSameHost follows redirects within the host of the request
+	// only, returning the others like RedirectNone
+	RedirectSameHost
+)
+
+// RedirectPolicy decides which redirects urlfetch follows.
+type RedirectPolicy struct {
+	Mode RedirectMode
+	// MaxHops bounds the redirects followed, DefaultMaxRedirects if zero
+	MaxHops int
+}
+
+// RedirectError is returned when a URL redirects more than MaxHops times.
+type RedirectError struct {
+	URL  string
+	Hops int
+}
+
+func (e *RedirectError) Error() string {
+	return fmt.Sprintf("fetcher: %s stopped after %d redirects", e.URL, e.Hops)
+}
+
+func (p RedirectPolicy) maxHops() int {
+	if p.MaxHops > 0 {
+		return p.MaxHops
+	}
+	return DefaultMaxRedirects
+}
+
+// client returns a urlfetch client applying the redirect policy of f and
+// recording the URLs that redirected in redirects.
+func (f *Fetcher) client(c context.Context, redirects *[]string) *http.Client {
+	client := urlfetch.Client(c)
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		*redirects = (*redirects)[:0]
+		for _, r := range via {
+			*redirects = append(*redirects, r.URL.String())
+		}
+		switch f.Redirect.Mode {
+		case RedirectNone:
+			return http.ErrUseLastResponse
+		case RedirectSameHost:
+			if req.URL.Host != via[0].URL.Host {
+				return http.ErrUseLastResponse
+			}
+		}
+		if len(via) > f.Redirect.maxHops() {
+			return &RedirectError{URL: via[0].URL.String(), Hops: len(via) - 1}
+		}
+		return nil
+	}
+	return client
+}
+
+// unwrapURLError returns the error http.Client wrapped in a *url.Error.
+func unwrapURLError(err error) error {
+	if ue, ok := err.(*url.Error); ok {
+		return ue.Err
+	}
+	return err
+}
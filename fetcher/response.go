@@ -0,0 +1,100 @@
+package fetcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Outcomes of the URLs listed in FetchResult.Errors
+const (
+	OutcomeRetried      = "retried"
+	OutcomeDeadLettered = "dead_lettered"
+	OutcomeDropped      = "dropped"
+	OutcomeSkipped      = "skipped"
+)
+
+// FetchResult is the body of a 200 response of the fetcher. The task
+// succeeded even if some URLs failed: those are listed in Errors, and
+// were either retried in a new task, dead-lettered, dropped or skipped.
+type FetchResult struct {
+	FetchStat
+	Errors []URLError `json:"errors,omitempty"`
+}
+
+type URLError struct {
+	URL     string `json:"url"`
+	Error   string `json:"error"`
+	Outcome string `json:"outcome"`
+	Topic   string `json:"topic,omitempty"`
+}
+
+// ErrorResponse is the body of every other response. A 400 response means
+// the task payload is invalid and must not be retried. A 500 response
+// means that enqueueing crawled links or retries failed and the whole task
+// should be retried: the fetches were already recorded in the history, and
+// entries may have been published, which Conditional or Dedup keep from
+// being published again.
+type ErrorResponse struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		body, _ = json.Marshal(&ErrorResponse{Status: status, Error: err.Error()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, &ErrorResponse{Status: status, Error: err.Error()})
+}
+
+func urlErrors(errors []*FetchError, outcome string) []URLError {
+	result := make([]URLError, len(errors))
+	for i, e := range errors {
+		result[i] = URLError{URL: e.URL, Error: e.Error.Error(), Outcome: outcome, Topic: e.Topic}
+	}
+	return result
+}
+
+// validate rejects requests that can never succeed, so that they are
+// answered with 400 instead of being retried.
+func (f *Fetcher) validate(request *FetchRequest) error {
+	if len(request.URLs) == 0 {
+		return fmt.Errorf("fetcher: no urls")
+	}
+	for _, t := range request.URLs {
+		if t.URL == "" {
+			return fmt.Errorf("fetcher: empty url")
+		}
+	}
+	sink, err := f.sink(request)
+	if err != nil {
+		return err
+	}
+	// Sync requests don't publish
+	if _, ok := sink.(*PubsubSink); ok && !request.sync && len(f.topics(request)) == 0 {
+		return fmt.Errorf("fetcher: no topic")
+	}
+	if _, err := f.transformers(request); err != nil {
+		return err
+	}
+	if request.Crawl != nil {
+		if request.Crawl.Depth > 0 && request.Crawl.ID == "" {
+			return fmt.Errorf("fetcher: crawl below the seeds without id")
+		}
+		if _, err := compilePatterns(request.Crawl.Include); err != nil {
+			return err
+		}
+		if _, err := compilePatterns(request.Crawl.Exclude); err != nil {
+			return err
+		}
+	}
+	return nil
+}
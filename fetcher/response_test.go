@@ -0,0 +1,35 @@
+package fetcher
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	sinks := map[string]Sink{"store": &DatastoreSink{Kind: "Page"}}
+	tests := []struct {
+		name    string
+		fetcher *Fetcher
+		request FetchRequest
+		valid   bool
+	}{
+		{"request topic", &Fetcher{}, FetchRequest{URLs: Targets("http://a/"), Topic: "t"}, true},
+		{"fetcher topic", &Fetcher{Topic: "t"}, FetchRequest{URLs: Targets("http://a/")}, true},
+		{"fetcher topics", &Fetcher{Topics: []string{"t"}}, FetchRequest{URLs: Targets("http://a/")}, true},
+		{"no topic", &Fetcher{}, FetchRequest{URLs: Targets("http://a/")}, false},
+		{"no topic sync", &Fetcher{}, FetchRequest{URLs: Targets("http://a/"), sync: true}, true},
+		{"other sink", &Fetcher{Sinks: sinks}, FetchRequest{URLs: Targets("http://a/"), Sink: "store"}, true},
+		{"unknown sink", &Fetcher{Topic: "t"}, FetchRequest{URLs: Targets("http://a/"), Sink: "store"}, false},
+		{"no urls", &Fetcher{Topic: "t"}, FetchRequest{}, false},
+		{"empty url", &Fetcher{Topic: "t"}, FetchRequest{URLs: Targets("")}, false},
+		{"bad transform", &Fetcher{Topic: "t"}, FetchRequest{URLs: Targets("http://a/"),
+			Transform: []TransformSpec{{Name: "nope"}}}, false},
+		{"bad crawl pattern", &Fetcher{Topic: "t"}, FetchRequest{URLs: Targets("http://a/"),
+			Crawl: &Crawl{Include: []string{"("}}}, false},
+		{"crawl without id", &Fetcher{Topic: "t"}, FetchRequest{URLs: Targets("http://a/"),
+			Crawl: &Crawl{Depth: 1, MaxDepth: 2}}, false},
+	}
+	for _, test := range tests {
+		err := test.fetcher.validate(&test.request)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: validate = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package fetcher
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/api/pubsub/v1beta2"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultMaxAttempts   = 5
+	DefaultRetryDelay    = 30 * time.Second
+	DefaultMaxRetryDelay = time.Hour
+)
+
+// sensitiveHeaders are stripped from the targets of dead letters, which
+// are requeued without them.
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// redactTarget returns t without its sensitiveHeaders.
+func redactTarget(t *Target) *Target {
+	redacted := *t
+	redacted.Headers = nil
+headers:
+	for k, v := range t.Headers {
+		for _, h := range sensitiveHeaders {
+			if strings.EqualFold(k, h) {
+				continue headers
+			}
+		}
+		if redacted.Headers == nil {
+			redacted.Headers = make(map[string]string)
+		}
+		redacted.Headers[k] = v
+	}
+	return &redacted
+}
+
+// DeadLetter is the entity stored for a URL that exhausted its retries.
+// Target is stored without its sensitiveHeaders.
+type DeadLetter struct {
+	URL    string
+	Target []byte `datastore:",noindex"`
+	Topics []string
+	// Options is a JSON FetchRequest with the sink, workers, transform
+	// and crawl of the failed request
+	Options  []byte `datastore:",noindex"`
+	Path     string `datastore:",noindex"`
+	Queue    string `datastore:",noindex"`
+	Error    string `datastore:",noindex"`
+	Attempts int
+	Created  time.Time
+}
+
+func (f *Fetcher) maxAttempts() int {
+	if f.MaxAttempts > 0 {
+		return f.MaxAttempts
+	}
+	return DefaultMaxAttempts
+}
+
+// backoff returns the delay before the given attempt.
+func (f *Fetcher) backoff(attempt int) time.Duration {
+	delay, max := f.RetryDelay, f.MaxRetryDelay
+	if delay <= 0 {
+		delay = DefaultRetryDelay
+	}
+	if max <= 0 {
+		max = DefaultMaxRetryDelay
+	}
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// DeadLetter hands URLs that won't be retried anymore to the dead-letter
+// topic and kind of f, or only logs them if neither is set. The topic gets
+// batches within the Pub/Sub limits, with attribute values truncated.
+func (f *Fetcher) DeadLetter(request *FetchRequest, errors []*FetchError, attempts int) error {
+	now := time.Now()
+	options, err := json.Marshal(&FetchRequest{Sink: request.Sink, Workers: request.Workers,
+		Transform: request.Transform, Crawl: request.Crawl})
+	if err != nil {
+		return err
+	}
+	letters := make([]*DeadLetter, len(errors))
+	for i, e := range errors {
+		target, err := json.Marshal(redactTarget(e.Target))
+		if err != nil {
+			return err
+		}
+		topics := request.Topics
+		if request.Topic != "" {
+			topics = append(topics[:len(topics):len(topics)], request.Topic)
+		}
+		if e.Topic != "" {
+			topics = []string{e.Topic}
+		}
+		letters[i] = &DeadLetter{
+			URL:      e.URL,
+			Target:   target,
+			Topics:   topics,
+			Options:  options,
+			Path:     request.Request.URL.Path,
+			Queue:    request.Request.Header.Get("X-AppEngine-QueueName"),
+			Error:    e.Error.Error(),
+			Attempts: attempts,
+			Created:  now,
+		}
+		log.Warningf(request.Context, "fetcher: giving up on %s after %d attempts: %v",
+			e.URL, attempts, e.Error)
+	}
+
+	// The topic and kind are written independently, returning the first
+	// error
+	if f.DeadLetterTopic != "" {
+		var batches []*batch
+		for i, l := range letters {
+			m := &pubsub.PubsubMessage{
+				Attributes: map[string]string{
+					"url":       truncateAttribute(l.URL),
+					"topics":    truncateAttribute(strings.Join(l.Topics, ",")),
+					"error":     truncateAttribute(l.Error),
+					"attempts":  strconv.Itoa(l.Attempts),
+					"failed_at": l.Created.UTC().Format(time.RFC3339Nano),
+				},
+				Data: base64.StdEncoding.EncodeToString(l.Target),
+			}
+			batches = addToBatches(batches, &FetchResponse{URL: l.URL, Target: errors[i].Target}, m)
+		}
+		var service *pubsub.Service
+		service, err = f.pubsubService(request.Context)
+		if err == nil {
+			if failed := f.publishBatches(request.Context, service, f.DeadLetterTopic, batches); len(failed) > 0 {
+				err = fmt.Errorf("fetcher: %d dead letters not published: %v", len(failed), failed[0].Error)
+			}
+		}
+	}
+
+	if f.DeadLetterKind != "" {
+		storeErr := eachBatch(len(letters), func(start, end int) error {
+			batch := letters[start:end]
+			keys := make([]*datastore.Key, len(batch))
+			for j := range batch {
+				keys[j] = datastore.NewIncompleteKey(request.Context, f.DeadLetterKind, nil)
+			}
+			_, err := datastore.PutMulti(request.Context, keys, batch)
+			return err
+		})
+		if err == nil {
+			err = storeErr
+		}
+	}
+	return err
+}
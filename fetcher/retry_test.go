@@ -0,0 +1,54 @@
+package fetcher
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		fetcher *Fetcher
+		attempt int
+		want    time.Duration
+	}{
+		{&Fetcher{}, 1, DefaultRetryDelay},
+		{&Fetcher{}, 2, 2 * DefaultRetryDelay},
+		{&Fetcher{}, 3, 4 * DefaultRetryDelay},
+		{&Fetcher{}, 100, DefaultMaxRetryDelay},
+		{&Fetcher{RetryDelay: time.Second}, 1, time.Second},
+		{&Fetcher{RetryDelay: time.Second}, 4, 8 * time.Second},
+		{&Fetcher{RetryDelay: time.Second, MaxRetryDelay: 5 * time.Second}, 3, 4 * time.Second},
+		{&Fetcher{RetryDelay: time.Second, MaxRetryDelay: 5 * time.Second}, 4, 5 * time.Second},
+		{&Fetcher{RetryDelay: time.Minute, MaxRetryDelay: time.Second}, 1, time.Second},
+	}
+	for i, test := range tests {
+		if got := test.fetcher.backoff(test.attempt); got != test.want {
+			t.Errorf("%d: backoff(%d) = %v, want %v", i, test.attempt, got, test.want)
+		}
+	}
+}
+
+func TestMaxAttempts(t *testing.T) {
+	if got := (&Fetcher{}).maxAttempts(); got != DefaultMaxAttempts {
+		t.Errorf("maxAttempts() = %d, want %d", got, DefaultMaxAttempts)
+	}
+	if got := (&Fetcher{MaxAttempts: 2}).maxAttempts(); got != 2 {
+		t.Errorf("maxAttempts() = %d, want 2", got)
+	}
+}
+
+func TestRedactTarget(t *testing.T) {
+	target := &Target{URL: "http://a/", Method: "POST", Headers: map[string]string{
+		"authorization": "Bearer x", "Cookie": "s=1", "Proxy-Authorization": "y", "Accept": "text/html"}}
+	redacted := redactTarget(target)
+	if !reflect.DeepEqual(redacted.Headers, map[string]string{"Accept": "text/html"}) {
+		t.Errorf("redactTarget headers = %v", redacted.Headers)
+	}
+	if len(target.Headers) != 4 || redacted.URL != target.URL || redacted.Method != target.Method {
+		t.Errorf("redactTarget changed the target or dropped its fields")
+	}
+	if redactTarget(&Target{URL: "http://a/"}).Headers != nil {
+		t.Errorf("redactTarget added headers")
+	}
+}
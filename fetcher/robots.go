@@ -0,0 +1,253 @@
+package fetcher
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+	"google.golang.org/appengine/urlfetch"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultRobotsTTL = 24 * time.Hour
+
+// MaxRobotsSize bounds the robots.txt read, the rules after it are ignored
+const MaxRobotsSize = 500 << 10
+
+var ErrDisallowed = errors.New("fetcher: disallowed by robots.txt")
+
+type robotsRule struct {
+	path  string
+	allow bool
+}
+
+type robots struct {
+	rules      []robotsRule
+	crawlDelay time.Duration
+	expires    time.Time
+}
+
+// parseRobots returns the rules of the group matching agent, falling back
+// to the "*" group.
+func parseRobots(content []byte, agent string) *robots {
+	agent = strings.ToLower(agent)
+	var matched, wildcard *robots
+	var current []*robots
+	inAgents := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+
+		switch key {
+		case "user-agent":
+			if !inAgents {
+				current = nil
+				inAgents = true
+			}
+			r := &robots{}
+			ua := strings.ToLower(value)
+			if ua == "*" {
+				if wildcard == nil {
+					wildcard = r
+				}
+			} else if agent != "" && strings.Contains(agent, ua) && matched == nil {
+				matched = r
+			}
+			current = append(current, r)
+		case "allow", "disallow":
+			inAgents = false
+			if key == "disallow" && value == "" {
+				continue
+			}
+			for _, r := range current {
+				r.rules = append(r.rules, robotsRule{path: value, allow: key == "allow"})
+			}
+		case "crawl-delay":
+			inAgents = false
+			if d, err := strconv.ParseFloat(value, 64); err == nil && d > 0 {
+				for _, r := range current {
+					r.crawlDelay = time.Duration(d * float64(time.Second))
+				}
+			}
+		}
+	}
+	if matched != nil {
+		return matched
+	}
+	if wildcard != nil {
+		return wildcard
+	}
+	return &robots{}
+}
+
+func matchRobotsPath(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	parts := strings.Split(strings.TrimSuffix(pattern, "$"), "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	expr := "^" + strings.Join(parts, ".*")
+	if anchored {
+		expr += "$"
+	}
+	matched, _ := regexp.MatchString(expr, path)
+	return matched
+}
+
+// allowed applies the longest matching rule, preferring Allow on ties.
+func (r *robots) allowed(path string) bool {
+	allow, length := true, -1
+	for _, rule := range r.rules {
+		if !matchRobotsPath(rule.path, path) {
+			continue
+		}
+		if len(rule.path) > length || len(rule.path) == length && rule.allow {
+			allow, length = rule.allow, len(rule.path)
+		}
+	}
+	return allow
+}
+
+func (f *Fetcher) robotsTTL() time.Duration {
+	if f.RobotsTTL > 0 {
+		return f.RobotsTTL
+	}
+	return DefaultRobotsTTL
+}
+
+// robotsLimit is the number of bytes of robots.txt read, MaxRobotsSize or
+// MaxBodySize if lower.
+func (f *Fetcher) robotsLimit() int64 {
+	if f.MaxBodySize > 0 && f.MaxBodySize < MaxRobotsSize {
+		return f.MaxBodySize
+	}
+	return MaxRobotsSize
+}
+
+// robotsKey identifies the robots.txt of u in both caches, http and https
+// having their own.
+func robotsKey(u *url.URL) string {
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+func (f *Fetcher) loadRobots(c context.Context, u *url.URL) (content []byte, err error) {
+	key := "fetcher:robots:" + robotsKey(u)
+	if item, err := memcache.Get(c, key); err == nil {
+		return item.Value, nil
+	}
+
+	robotsURL := u.Scheme + "://" + u.Host + "/robots.txt"
+	req, err := http.NewRequest("GET", robotsURL, nil)
+	if err != nil {
+		return
+	}
+	if f.UserAgent != "" {
+		req.Header.Set("User-Agent", f.UserAgent)
+	}
+	resp, err := urlfetch.Client(c).Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 500:
+		return nil, fmt.Errorf("fetcher: %s returned %s", robotsURL, resp.Status)
+	case resp.StatusCode >= 400:
+		// No robots.txt, everything is allowed
+		content = []byte{}
+	default:
+		content, err = ioutil.ReadAll(io.LimitReader(resp.Body, f.robotsLimit()))
+		if err != nil {
+			return
+		}
+	}
+
+	memcache.Set(c, &memcache.Item{
+		Key:        key,
+		Value:      content,
+		Expiration: f.robotsTTL(),
+	})
+	return
+}
+
+func (f *Fetcher) robots(c context.Context, u *url.URL) (*robots, error) {
+	host, key := strings.ToLower(u.Host), robotsKey(u)
+	f.mu.Lock()
+	r, ok := f.robotsCache[key]
+	f.mu.Unlock()
+	if ok && time.Now().Before(r.expires) {
+		return r, nil
+	}
+
+	content, err := f.loadRobots(c, u)
+	if err != nil {
+		return nil, err
+	}
+	r = parseRobots(content, f.UserAgent)
+	r.expires = time.Now().Add(f.robotsTTL())
+
+	f.mu.Lock()
+	if f.robotsCache == nil {
+		f.robotsCache = make(map[string]*robots)
+	}
+	f.robotsCache[key] = r
+	f.mu.Unlock()
+
+	if r.crawlDelay > 0 {
+		f.limiter(host).slowDown(RateLimit{Rate: 1 / r.crawlDelay.Seconds(), Burst: 1})
+	}
+	return r, nil
+}
+
+// checkRobots returns ErrDisallowed if robots.txt forbids fetching rawurl.
+func (f *Fetcher) checkRobots(c context.Context, rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	r, err := f.robots(c, u)
+	if err != nil {
+		return err
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	if !r.allowed(path) {
+		return ErrDisallowed
+	}
+	return nil
+}
+
+func splitSkipped(errors []*FetchError) (failed, skipped []*FetchError) {
+	for _, e := range errors {
+		if e.Error == ErrDisallowed {
+			skipped = append(skipped, e)
+		} else {
+			failed = append(failed, e)
+		}
+	}
+	return
+}
@@ -0,0 +1,139 @@
+package fetcher
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+const testRobots = `
+# comment
+User-agent: *
+Disallow: /private/
+Allow: /private/public
+Crawl-delay: 2
+
+User-agent: FooBot
+User-agent: BarBot
+Disallow: /
+Allow: /open$
+Crawl-delay: 0.5
+
+User-agent: EmptyBot
+Disallow:
+`
+
+func TestParseRobots(t *testing.T) {
+	tests := []struct {
+		agent      string
+		path       string
+		allowed    bool
+		crawlDelay time.Duration
+	}{
+		{"", "/", true, 2 * time.Second},
+		{"", "/private/x", false, 2 * time.Second},
+		{"", "/private/public/x", true, 2 * time.Second},
+		{"OtherBot/1.0", "/private/", false, 2 * time.Second},
+		{"FooBot/1.0", "/anything", false, 500 * time.Millisecond},
+		{"foobot", "/open", true, 500 * time.Millisecond},
+		{"foobot", "/open/x", false, 500 * time.Millisecond},
+		{"BarBot", "/", false, 500 * time.Millisecond},
+		{"EmptyBot", "/private/x", true, 0},
+	}
+	for i, test := range tests {
+		r := parseRobots([]byte(testRobots), test.agent)
+		if got := r.allowed(test.path); got != test.allowed {
+			t.Errorf("%d: %q allowed(%q) = %v, want %v", i, test.agent, test.path, got, test.allowed)
+		}
+		if r.crawlDelay != test.crawlDelay {
+			t.Errorf("%d: %q crawl delay = %v, want %v", i, test.agent, r.crawlDelay, test.crawlDelay)
+		}
+	}
+}
+
+func TestParseRobotsEmpty(t *testing.T) {
+	r := parseRobots([]byte("garbage\n\n"), "FooBot")
+	if !r.allowed("/x") {
+		t.Errorf("allowed(/x) = false, want true")
+	}
+}
+
+func TestMatchRobotsPath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"/", "/", true},
+		{"/a", "/abc", true},
+		{"/a", "/b", false},
+		{"/a$", "/a", true},
+		{"/a$", "/ab", false},
+		{"/*.php", "/x/y.php", true},
+		{"/*.php$", "/x/y.php?q", false},
+		{"/a*b", "/a/x/b/c", true},
+		{"/a.b", "/axb", false},
+		{"/a?q=1", "/a?q=1&r", true},
+	}
+	for _, test := range tests {
+		if got := matchRobotsPath(test.pattern, test.path); got != test.want {
+			t.Errorf("matchRobotsPath(%q, %q) = %v, want %v", test.pattern, test.path, got, test.want)
+		}
+	}
+}
+
+func TestRobotsAllowed(t *testing.T) {
+	tests := []struct {
+		rules []robotsRule
+		path  string
+		want  bool
+	}{
+		{nil, "/", true},
+		{[]robotsRule{{"/a", false}}, "/a/b", false},
+		{[]robotsRule{{"/a", false}, {"/a/b", true}}, "/a/b", true},
+		{[]robotsRule{{"/a/b", true}, {"/a", false}}, "/a/c", false},
+		// Allow wins ties
+		{[]robotsRule{{"/a", false}, {"/a", true}}, "/a", true},
+		{[]robotsRule{{"/a", true}, {"/a", false}}, "/a", true},
+	}
+	for i, test := range tests {
+		r := &robots{rules: test.rules}
+		if got := r.allowed(test.path); got != test.want {
+			t.Errorf("%d: allowed(%q) = %v, want %v", i, test.path, got, test.want)
+		}
+	}
+}
+
+func TestRobotsKey(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"http://a.com/x", "http://a.com"},
+		{"https://a.com/x", "https://a.com"},
+		{"HTTP://A.com:8080/x", "http://a.com:8080"},
+	}
+	for _, test := range tests {
+		u, _ := url.Parse(test.url)
+		if got := robotsKey(u); got != test.want {
+			t.Errorf("robotsKey(%q) = %q, want %q", test.url, got, test.want)
+		}
+	}
+}
+
+func TestRobotsLimit(t *testing.T) {
+	tests := []struct {
+		maxBodySize int64
+		want        int64
+	}{
+		{0, MaxRobotsSize},
+		{1 << 10, 1 << 10},
+		{10 << 20, MaxRobotsSize},
+	}
+	for _, test := range tests {
+		f := &Fetcher{MaxBodySize: test.maxBodySize}
+		if got := f.robotsLimit(); got != test.want {
+			t.Errorf("robotsLimit with MaxBodySize %d = %d, want %d", test.maxBodySize, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package fetcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/porter-io/appengine-toolkit/mapentity"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/urlfetch"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Sink is the destination of fetched entries. Write returns the entries it
+// failed to write as errors, and err if it couldn't write anything.
+type Sink interface {
+	Write(f *Fetcher, request *FetchRequest, entries []*FetchResponse) (errors []*FetchError, err error)
+}
+
+func (f *Fetcher) sink(request *FetchRequest) (Sink, error) {
+	if request.Sink != "" {
+		sink, ok := f.Sinks[request.Sink]
+		if !ok {
+			return nil, fmt.Errorf("fetcher: unknown sink %q", request.Sink)
+		}
+		return sink, nil
+	}
+	if f.Sink != nil {
+		return f.Sink, nil
+	}
+	return &PubsubSink{}, nil
+}
+
+func failAll(entries []*FetchResponse, err error) (errors []*FetchError) {
+	for _, e := range entries {
+		errors = append(errors, &FetchError{URL: e.URL, Target: e.Target, Error: err})
+	}
+	return
+}
+
+// PubsubSink publishes entries to the topics of the request or the fetcher,
+// offloading large content and dropping messages Pub/Sub won't accept.
+type PubsubSink struct{}
+
+func (s *PubsubSink) Write(f *Fetcher, request *FetchRequest, entries []*FetchResponse) (errors []*FetchError, err error) {
+	topics := f.topics(request)
+	if len(topics) == 0 {
+		return nil, fmt.Errorf("fetcher: topic is empty")
+	}
+	service, err := f.pubsubService(request.Context)
+	if err != nil {
+		return
+	}
+	entries, errors = f.offload(request, entries)
+	entries, oversize := f.splitOversize(entries)
+	errors = append(errors, oversize...)
+	batches, failed := f.batches(entries)
+	errors = append(errors, failed...)
+	for _, topic := range topics {
+		errors = append(errors, f.publishBatches(request.Context, service, topic, batches)...)
+	}
+	return errors, nil
+}
+
+// Largest content a DatastoreSink stores inline, leaving room for the other
+// properties under the 1 MB entity limit.
+const datastoreMaxContentSize = 1<<20 - 16<<10
+
+// datastoreMaxBatchBytes bounds the estimated size of the entities of a
+// single PutMulti, below the 10 MB limit of a datastore API call.
+const datastoreMaxBatchBytes = 8 << 20
+
+// entitySize estimates the stored size of the entity of e.
+func entitySize(e *FetchResponse) int {
+	size := 1<<10 + len(e.URL) + len(e.FinalURL) + len(e.StorageURL)
+	for _, r := range e.Redirects {
+		size += len(r)
+	}
+	if e.StorageURL == "" {
+		size += len(e.Content)
+	}
+	return size
+}
+
+// entityBatches splits entries into batches within both the entity count
+// and the byte size limits of a datastore call.
+func entityBatches(entries []*FetchResponse) (batches [][]*FetchResponse) {
+	var current []*FetchResponse
+	size := 0
+	for _, e := range entries {
+		n := entitySize(e)
+		if len(current) > 0 && (len(current) == datastoreBatchSize || size+n > datastoreMaxBatchBytes) {
+			batches = append(batches, current)
+			current, size = nil, 0
+		}
+		current = append(current, e)
+		size += n
+	}
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+	return
+}
+
+// DatastoreSink stores the latest entry of every URL as an entity of Kind,
+// keyed by the SHA-1 of the URL. Content too large for an entity is offloaded
+// to OffloadBucket when set, and dropped as a permanent error otherwise.
+type DatastoreSink struct {
+	Kind string
+}
+
+func (s *DatastoreSink) Write(f *Fetcher, request *FetchRequest, entries []*FetchResponse) (errors []*FetchError, err error) {
+	if s.Kind == "" {
+		return nil, fmt.Errorf("fetcher: datastore sink kind is empty")
+	}
+	c := request.Context
+	entries, errors = f.offloadAbove(request, entries, datastoreMaxContentSize)
+	entries, oversize := splitEntityOversize(entries)
+	errors = append(errors, oversize...)
+	for _, batch := range entityBatches(entries) {
+		keys := make([]*datastore.Key, len(batch))
+		src := make([]mapentity.NoIndexMapEntity, len(batch))
+		for j, e := range batch {
+			keys[j] = datastore.NewKey(c, s.Kind, urlHash(e.URL), 0, nil)
+			src[j] = mapentity.NoIndexMapEntity{
+				"url":          e.URL,
+				"final_url":    e.FinalURL,
+				"redirects":    e.Redirects,
+				"status_code":  e.StatusCode,
+				"content_type": e.ContentType,
+				"charset":      e.Charset,
+				"fetched_at":   e.Fetched,
+				"content_hash": e.Hash,
+				"truncated":    e.Truncated,
+				"storage_url":  e.StorageURL,
+			}
+			if e.StorageURL == "" {
+				src[j]["content"] = e.Content
+			}
+		}
+		if _, err := datastore.PutMulti(c, keys, src); err != nil {
+			// Retry one by one so a single bad entity doesn't fail the batch.
+			for j, e := range batch {
+				if _, err := datastore.Put(c, keys[j], src[j]); err != nil {
+					errors = append(errors, failAll([]*FetchResponse{e}, err)...)
+				}
+			}
+		}
+	}
+	return
+}
+
+// splitEntityOversize drops the entries whose inline content wouldn't fit
+// in a datastore entity.
+func splitEntityOversize(entries []*FetchResponse) (fit []*FetchResponse, oversize []*FetchError) {
+	for _, e := range entries {
+		if e.StorageURL == "" && len(e.Content) > datastoreMaxContentSize {
+			oversize = append(oversize, &FetchError{URL: e.URL, Target: e.Target,
+				Error: &SizeError{URL: e.URL, Limit: datastoreMaxContentSize}, Permanent: true})
+			continue
+		}
+		fit = append(fit, e)
+	}
+	return
+}
+
+// StorageSink writes every entry to an object of Bucket named after the
+// hash of its URL and the fetch time.
+type StorageSink struct {
+	Bucket string
+}
+
+func (s *StorageSink) Write(f *Fetcher, request *FetchRequest, entries []*FetchResponse) (errors []*FetchError, err error) {
+	if s.Bucket == "" {
+		return nil, fmt.Errorf("fetcher: storage sink bucket is empty")
+	}
+	service, err := f.storageService(request.Context)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if err := f.upload(service, s.Bucket, objectName(e), e); err != nil {
+			errors = append(errors, failAll([]*FetchResponse{e}, err)...)
+		}
+	}
+	return
+}
+
+// WebhookSink POSTs every entry as a JSON Envelope to URL, any status but
+// 2xx counting as a failure.
+type WebhookSink struct {
+	URL     string
+	Headers map[string]string
+}
+
+func (s *WebhookSink) post(f *Fetcher, request *FetchRequest, e *FetchResponse) error {
+	body, err := json.Marshal(envelope(e))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if f.UserAgent != "" {
+		req.Header.Set("User-Agent", f.UserAgent)
+	}
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := urlfetch.Client(request.Context).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &StatusError{URL: s.URL, StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+func (s *WebhookSink) Write(f *Fetcher, request *FetchRequest, entries []*FetchResponse) (errors []*FetchError, err error) {
+	if s.URL == "" {
+		return nil, fmt.Errorf("fetcher: webhook sink url is empty")
+	}
+	for _, e := range entries {
+		if err := s.post(f, request, e); err != nil {
+			errors = append(errors, failAll([]*FetchResponse{e}, err)...)
+		}
+	}
+	return
+}
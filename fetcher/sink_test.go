@@ -0,0 +1,89 @@
+package fetcher
+
+import (
+	"bytes"
+	"golang.org/x/net/context"
+	"reflect"
+	"testing"
+)
+
+func TestSplitEntityOversize(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), datastoreMaxContentSize+1)
+	tests := []struct {
+		name       string
+		content    []byte
+		storageURL string
+		fit        bool
+	}{
+		{"small", []byte("abc"), "", true},
+		{"at limit", large[:datastoreMaxContentSize], "", true},
+		{"over limit", large, "", false},
+		{"offloaded", large, "gs://bucket/object", true},
+	}
+	for _, test := range tests {
+		e := testEntry("http://a/"+test.name, "", testTime)
+		e.Content, e.StorageURL = test.content, test.storageURL
+		fit, oversize := splitEntityOversize([]*FetchResponse{e})
+		if test.fit && (len(fit) != 1 || len(oversize) != 0) {
+			t.Errorf("%s: dropped an entry that fits", test.name)
+		}
+		if !test.fit && (len(fit) != 0 || len(oversize) != 1 || !oversize[0].Permanent) {
+			t.Errorf("%s: kept an oversize entry", test.name)
+		}
+	}
+}
+
+func TestOffloadAbove(t *testing.T) {
+	s := newFakeStorage(t)
+	defer s.Close()
+	f := storageFetcher(s)
+	f.OffloadBucket = "bucket"
+
+	small := testEntry("http://a/small", "abc", testTime)
+	large := testEntry("http://a/large", "abcdef", testTime)
+	result, errors := f.offloadAbove(&FetchRequest{Context: context.Background()}, []*FetchResponse{small, large}, 4)
+	if len(errors) != 0 || len(result) != 2 {
+		t.Fatalf("offloadAbove = %d entries, %v", len(result), errors)
+	}
+	if small.StorageURL != "" || large.StorageURL == "" {
+		t.Errorf("offloadAbove storage URLs = %q, %q, want only the large entry offloaded", small.StorageURL, large.StorageURL)
+	}
+}
+
+func TestEntityBatches(t *testing.T) {
+	entries := func(n, size int, storageURL string) (entries []*FetchResponse) {
+		for i := 0; i < n; i++ {
+			e := testEntry("http://a/", "", testTime)
+			e.Content, e.StorageURL = make([]byte, size), storageURL
+			entries = append(entries, e)
+		}
+		return
+	}
+	tests := []struct {
+		name    string
+		entries []*FetchResponse
+		sizes   []int
+	}{
+		{"small", entries(1200, 10, ""), []int{500, 500, 200}},
+		{"large", entries(20, 1<<20-32<<10, ""), []int{8, 8, 4}},
+		{"offloaded", entries(600, 1<<20, "gs://b/o"), []int{500, 100}},
+		{"none", nil, nil},
+	}
+	for _, test := range tests {
+		batches := entityBatches(test.entries)
+		var sizes []int
+		for _, b := range batches {
+			sizes = append(sizes, len(b))
+			total := 0
+			for _, e := range b {
+				total += entitySize(e)
+			}
+			if total > datastoreMaxBatchBytes {
+				t.Errorf("%s: batch of %d bytes", test.name, total)
+			}
+		}
+		if !reflect.DeepEqual(sizes, test.sizes) {
+			t.Errorf("%s: batch sizes = %v, want %v", test.name, sizes, test.sizes)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package fetcher
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Largest encodedSize of a message, bounded by the publish request limit
+const PubsubMaxMessageSize = PubsubMaxBatchSize - publishRequestOverhead
+
+type OversizePolicy int
+
+const (
+	// TruncateOversize cuts bodies at MaxBodySize and flags them with the
+	// "truncated" attribute
+	TruncateOversize OversizePolicy = iota
+	// RejectOversize drops oversize bodies as permanent errors
+	RejectOversize
+)
+
+type SizeError struct {
+	URL   string
+	Limit int64
+}
+
+func (e *SizeError) Error() string {
+	return fmt.Sprintf("fetcher: %s exceeds %d bytes", e.URL, e.Limit)
+}
+
+// readBody reads at most MaxBodySize bytes of resp, reporting whether the
+// body was cut.
+func (f *Fetcher) readBody(resp *http.Response) (body []byte, truncated bool, err error) {
+	if f.MaxBodySize <= 0 {
+		body, err = ioutil.ReadAll(resp.Body)
+		return
+	}
+	body, err = ioutil.ReadAll(io.LimitReader(resp.Body, f.MaxBodySize+1))
+	if int64(len(body)) > f.MaxBodySize {
+		body, truncated = body[:f.MaxBodySize], true
+	}
+	return
+}
+
+// splitOversize drops the entries whose message wouldn't be accepted by
+// Pub/Sub.
+func (f *Fetcher) splitOversize(entries []*FetchResponse) (fit []*FetchResponse, oversize []*FetchError) {
+	for _, e := range entries {
+		m, err := f.message(e)
+		if err != nil {
+			oversize = append(oversize, &FetchError{URL: e.URL, Target: e.Target,
+				Error: err, Permanent: true})
+			continue
+		}
+		if encodedSize(m) > PubsubMaxMessageSize {
+			oversize = append(oversize, &FetchError{URL: e.URL, Target: e.Target,
+				Error: &SizeError{URL: e.URL, Limit: int64(PubsubMaxMessageSize)}, Permanent: true})
+			continue
+		}
+		fit = append(fit, e)
+	}
+	return
+}
@@ -0,0 +1,237 @@
+package fetcher
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"strings"
+	"time"
+)
+
+const DefaultStateKind = "FetcherURLState"
+
+// datastore limits the number of entities in a single batch operation
+const datastoreBatchSize = 500
+
+// eachBatch calls fn with the bounds of consecutive batches of n entities,
+// stopping at the first error.
+func eachBatch(n int, fn func(start, end int) error) error {
+	for start := 0; start < n; start += datastoreBatchSize {
+		end := start + datastoreBatchSize
+		if end > n {
+			end = n
+		}
+		if err := fn(start, end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanupRounds bounds the batches deleteExpired removes per call, keeping
+// it within a request deadline.
+const cleanupRounds = 10
+
+// CleanupResult reports the entities deleted by a cleanup and whether
+// expired ones remain, in which case it should run again.
+type CleanupResult struct {
+	Deleted int  `json:"deleted"`
+	More    bool `json:"more"`
+}
+
+// deleteExpired deletes the entities of kind whose Expires is past, at
+// most cleanupRounds batches at a time.
+func deleteExpired(c context.Context, kind string) (result CleanupResult, err error) {
+	now := time.Now()
+	for i := 0; i < cleanupRounds; i++ {
+		q := datastore.NewQuery(kind).Filter("Expires <", now).KeysOnly().Limit(datastoreBatchSize)
+		keys, err := q.GetAll(c, nil)
+		if err != nil {
+			return result, err
+		}
+		if err := datastore.DeleteMulti(c, keys); err != nil {
+			return result, err
+		}
+		result.Deleted += len(keys)
+		if len(keys) < datastoreBatchSize {
+			return result, nil
+		}
+	}
+	result.More = true
+	return result, nil
+}
+
+func urlHash(url string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(url)))
+}
+
+// URLState is what the fetcher remembers about a URL between fetches. URL
+// holds the stateKey of the target.
+type URLState struct {
+	URL          string `datastore:",noindex"`
+	ETag         string `datastore:",noindex"`
+	LastModified string `datastore:",noindex"`
+	Hash         string `datastore:",noindex"`
+	Updated      time.Time
+}
+
+// StateStore keeps the URLState of every state key.
+type StateStore interface {
+	Load(c context.Context, keys []string) (map[string]*URLState, error)
+	Save(c context.Context, states []*URLState) error
+}
+
+// DatastoreStateStore keeps one entity of Kind (DefaultStateKind if empty)
+// per state key, keyed by the SHA-1 of the state key.
+type DatastoreStateStore struct {
+	Kind string
+}
+
+func (s *DatastoreStateStore) key(c context.Context, url string) *datastore.Key {
+	kind := s.Kind
+	if kind == "" {
+		kind = DefaultStateKind
+	}
+	return datastore.NewKey(c, kind, urlHash(url), 0, nil)
+}
+
+func (s *DatastoreStateStore) Load(c context.Context, urls []string) (map[string]*URLState, error) {
+	states := make(map[string]*URLState)
+	err := eachBatch(len(urls), func(start, end int) error {
+		batch := urls[start:end]
+		keys := make([]*datastore.Key, len(batch))
+		for j := range batch {
+			keys[j] = s.key(c, batch[j])
+		}
+		dst := make([]URLState, len(batch))
+		err := datastore.GetMulti(c, keys, dst)
+		if me, ok := err.(appengine.MultiError); ok {
+			for j := range me {
+				if me[j] == nil {
+					states[batch[j]] = &dst[j]
+				} else if me[j] != datastore.ErrNoSuchEntity {
+					return me[j]
+				}
+			}
+		} else if err != nil {
+			return err
+		} else {
+			for j := range batch {
+				states[batch[j]] = &dst[j]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+func (s *DatastoreStateStore) Save(c context.Context, states []*URLState) error {
+	return eachBatch(len(states), func(start, end int) error {
+		batch := states[start:end]
+		keys := make([]*datastore.Key, len(batch))
+		for j := range batch {
+			keys[j] = s.key(c, batch[j].URL)
+		}
+		_, err := datastore.PutMulti(c, keys, batch)
+		return err
+	})
+}
+
+func (f *Fetcher) stateStore() StateStore {
+	if f.StateStore != nil {
+		return f.StateStore
+	}
+	return &DatastoreStateStore{}
+}
+
+// stateKey identifies the state of t: its URL for GET requests, and its
+// method, URL and body hash otherwise, so that different requests to the
+// same endpoint don't share validators and content hashes.
+func stateKey(t *Target) string {
+	method := strings.ToUpper(t.Method)
+	if method == "" || method == "GET" {
+		return t.URL
+	}
+	return method + " " + t.URL + " " + contentHash([]byte(t.Body))
+}
+
+func (f *Fetcher) loadStates(request *FetchRequest, urls []string) map[string]*URLState {
+	states, err := f.stateStore().Load(request.Context, urls)
+	if err != nil {
+		log.Warningf(request.Context, "fetcher: loading url states: %v", err)
+		return nil
+	}
+	return states
+}
+
+// saveStates records the validators and content hash of entries, so that
+// the next fetch of the same URL can be conditional and deduplicated.
+func (f *Fetcher) saveStates(request *FetchRequest, entries []*FetchResponse) {
+	if !f.Conditional && !f.Dedup {
+		return
+	}
+	now := time.Now()
+	var states []*URLState
+	for _, e := range entries {
+		state := &URLState{URL: stateKey(e.Target), Updated: now}
+		if f.Conditional {
+			state.ETag, state.LastModified = e.ETag, e.LastModified
+		}
+		if f.Dedup {
+			state.Hash = e.Hash
+		}
+		if state.ETag == "" && state.LastModified == "" && state.Hash == "" {
+			continue
+		}
+		states = append(states, state)
+	}
+	if len(states) == 0 {
+		return
+	}
+	if err := f.stateStore().Save(request.Context, states); err != nil {
+		log.Warningf(request.Context, "fetcher: saving url states: %v", err)
+	}
+}
+
+func splitUnchanged(entries []*FetchResponse) (changed, unchanged []*FetchResponse) {
+	for _, e := range entries {
+		if e.NotModified {
+			unchanged = append(unchanged, e)
+		} else {
+			changed = append(changed, e)
+		}
+	}
+	return
+}
+
+func contentHash(content []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(content))
+}
+
+// dedup splits off entries whose content is identical to what was last
+// published for the same URL.
+func (f *Fetcher) dedup(request *FetchRequest, entries []*FetchResponse) (changed, duplicates []*FetchResponse) {
+	if !f.Dedup {
+		return entries, nil
+	}
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		keys[i] = stateKey(e.Target)
+	}
+	states := f.loadStates(request, keys)
+	for _, e := range entries {
+		if state, ok := states[stateKey(e.Target)]; ok && state.Hash == e.Hash {
+			duplicates = append(duplicates, e)
+		} else {
+			changed = append(changed, e)
+		}
+	}
+	return
+}
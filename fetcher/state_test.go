@@ -0,0 +1,25 @@
+package fetcher
+
+import "testing"
+
+func TestStateKey(t *testing.T) {
+	tests := []struct {
+		target Target
+		want   string
+	}{
+		{Target{URL: "http://a/"}, "http://a/"},
+		{Target{URL: "http://a/", Method: "get"}, "http://a/"},
+		{Target{URL: "http://a/", Method: "HEAD"}, "HEAD http://a/ " + contentHash(nil)},
+		{Target{URL: "http://a/", Method: "post", Body: "x"}, "POST http://a/ " + contentHash([]byte("x"))},
+	}
+	for _, test := range tests {
+		if got := stateKey(&test.target); got != test.want {
+			t.Errorf("stateKey(%+v) = %q, want %q", test.target, got, test.want)
+		}
+	}
+	a := stateKey(&Target{URL: "http://a/", Method: "POST", Body: "1"})
+	b := stateKey(&Target{URL: "http://a/", Method: "POST", Body: "2"})
+	if a == b {
+		t.Errorf("POST targets with different bodies share state key %q", a)
+	}
+}
@@ -0,0 +1,83 @@
+package fetcher
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+type StatusClass int
+
+const (
+	StatusSuccess StatusClass = iota
+	// StatusPermanent responses are dropped and reported, never retried
+	StatusPermanent
+	// StatusTransient responses are handed to Retry
+	StatusTransient
+)
+
+// StatusPolicy overrides the class of individual status codes.
+type StatusPolicy map[int]StatusClass
+
+// DefaultStatusClass treats 2xx as success; 408, 429 and 5xx as transient
+// and everything else as permanent.
+func DefaultStatusClass(code int) StatusClass {
+	switch {
+	case code >= 200 && code < 300:
+		return StatusSuccess
+	case code == http.StatusRequestTimeout, code == http.StatusTooManyRequests, code >= 500:
+		return StatusTransient
+	}
+	return StatusPermanent
+}
+
+func (p StatusPolicy) Class(code int) StatusClass {
+	if class, ok := p[code]; ok {
+		return class
+	}
+	return DefaultStatusClass(code)
+}
+
+type StatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("fetcher: %s returned %d %s", e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+func (f *Fetcher) permanent(err error) bool {
+	switch e := err.(type) {
+	case *StatusError:
+		return f.StatusPolicy.Class(e.StatusCode) == StatusPermanent
+	case *SizeError, *RedirectError, *TargetError:
+		return true
+	}
+	return false
+}
+
+// splitPermanent splits off the errors that must not be retried.
+func splitPermanent(errors []*FetchError) (transient, permanent []*FetchError) {
+	for _, e := range errors {
+		if e.Permanent {
+			permanent = append(permanent, e)
+		} else {
+			transient = append(transient, e)
+		}
+	}
+	return
+}
+
+func countStatusCodes(result []*FetchResponse, errors []*FetchError) map[string]int {
+	codes := make(map[string]int)
+	for _, r := range result {
+		codes[strconv.Itoa(r.StatusCode)]++
+	}
+	for _, e := range errors {
+		if se, ok := e.Error.(*StatusError); ok {
+			codes[strconv.Itoa(se.StatusCode)]++
+		}
+	}
+	return codes
+}
@@ -0,0 +1,90 @@
+package fetcher
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/net/context"
+	"google.golang.org/api/storage/v1"
+)
+
+const DefaultOffloadThreshold = 1 << 20
+
+func (f *Fetcher) offloadThreshold() int {
+	if f.OffloadThreshold > 0 {
+		return f.OffloadThreshold
+	}
+	return DefaultOffloadThreshold
+}
+
+func (f *Fetcher) storageService(c context.Context) (*storage.Service, error) {
+	client, err := f.googleClient(c, storage.DevstorageReadWriteScope)
+	if err != nil {
+		return nil, err
+	}
+	service, err := storage.New(client)
+	if err != nil {
+		return nil, err
+	}
+	if f.StorageEndpoint != "" {
+		service.BasePath = f.StorageEndpoint
+	}
+	return service, nil
+}
+
+// objectName derives the name of the object holding the content of e from
+// the hash of its URL and the fetch time.
+func objectName(e *FetchResponse) string {
+	return fmt.Sprintf("%s/%s", urlHash(e.URL),
+		e.Fetched.UTC().Format("20060102T150405.000000000Z"))
+}
+
+func (f *Fetcher) upload(service *storage.Service, bucket, name string, e *FetchResponse) error {
+	object := &storage.Object{
+		Name:        name,
+		ContentType: e.ContentType,
+		Metadata: map[string]string{
+			"url":          e.URL,
+			"final_url":    e.FinalURL,
+			"content_hash": e.Hash,
+		},
+	}
+	_, err := service.Objects.Insert(bucket, object).Media(bytes.NewReader(e.Content)).Do()
+	return err
+}
+
+// offload moves the content of entries above OffloadThreshold to
+// OffloadBucket, so that only a reference to it gets published.
+func (f *Fetcher) offload(request *FetchRequest, entries []*FetchResponse) (result []*FetchResponse, errors []*FetchError) {
+	return f.offloadAbove(request, entries, f.offloadThreshold())
+}
+
+// offloadAbove moves the content of entries larger than threshold to
+// OffloadBucket.
+func (f *Fetcher) offloadAbove(request *FetchRequest, entries []*FetchResponse, threshold int) (result []*FetchResponse, errors []*FetchError) {
+	if f.OffloadBucket == "" {
+		return entries, nil
+	}
+	var service *storage.Service
+	for _, e := range entries {
+		if len(e.Content) <= threshold {
+			result = append(result, e)
+			continue
+		}
+		var err error
+		if service == nil {
+			service, err = f.storageService(request.Context)
+		}
+		name := objectName(e)
+		if err == nil {
+			err = f.upload(service, f.OffloadBucket, name, e)
+		}
+		if err != nil {
+			errors = append(errors, &FetchError{URL: e.URL, Target: e.Target,
+				Error: fmt.Errorf("fetcher: offloading %s: %v", e.URL, err)})
+			continue
+		}
+		e.StorageURL = fmt.Sprintf("gs://%s/%s", f.OffloadBucket, name)
+		result = append(result, e)
+	}
+	return
+}
@@ -0,0 +1,203 @@
+package fetcher
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeObject struct {
+	Bucket      string
+	Name        string
+	ContentType string
+	Metadata    map[string]string
+	Content     []byte
+}
+
+// fakeStorage accepts the multipart media uploads of Objects.Insert.
+type fakeStorage struct {
+	*httptest.Server
+	mu      sync.Mutex
+	objects []*fakeObject
+	fail    bool
+}
+
+func newFakeStorage(t *testing.T) *fakeStorage {
+	s := &fakeStorage{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/upload")
+		if r.Method != "POST" || !strings.HasPrefix(path, "/storage/v1/b/") ||
+			!strings.HasSuffix(path, "/o") || r.URL.Query().Get("uploadType") != "multipart" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			http.NotFound(w, r)
+			return
+		}
+		o := &fakeObject{Bucket: strings.TrimSuffix(strings.TrimPrefix(path, "/storage/v1/b/"), "/o")}
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			t.Errorf("upload content type: %v", err)
+			return
+		}
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		meta, err := mr.NextPart()
+		if err != nil {
+			t.Errorf("reading metadata part: %v", err)
+			return
+		}
+		if err := json.NewDecoder(meta).Decode(o); err != nil {
+			t.Errorf("decoding metadata part: %v", err)
+			return
+		}
+		media, err := mr.NextPart()
+		if err != nil {
+			t.Errorf("reading media part: %v", err)
+			return
+		}
+		if o.Content, err = ioutil.ReadAll(media); err != nil {
+			t.Errorf("reading media part: %v", err)
+			return
+		}
+		s.objects = append(s.objects, o)
+		json.NewEncoder(w).Encode(map[string]string{"bucket": o.Bucket, "name": o.Name})
+	}))
+	return s
+}
+
+func storageFetcher(s *fakeStorage) *Fetcher {
+	return &Fetcher{
+		StorageEndpoint: s.URL + "/storage/v1/",
+		apiClient: func(c context.Context, scope ...string) (*http.Client, error) {
+			return http.DefaultClient, nil
+		},
+	}
+}
+
+var testTime = time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func testEntry(url, content string, fetched time.Time) *FetchResponse {
+	return &FetchResponse{URL: url, Target: &Target{URL: url}, FinalURL: url + "?final",
+		Content: []byte(content), ContentType: "text/html", Fetched: fetched,
+		Hash: contentHash([]byte(content))}
+}
+
+func TestOffload(t *testing.T) {
+	s := newFakeStorage(t)
+	defer s.Close()
+	f := storageFetcher(s)
+	f.OffloadBucket, f.OffloadThreshold = "bucket", 4
+
+	now := time.Date(2016, 1, 2, 3, 4, 5, 6, time.UTC)
+	small := testEntry("http://a/small", "abc", now)
+	large := testEntry("http://a/large", "0123456789", now)
+	request := &FetchRequest{Context: context.Background()}
+	result, errors := f.offload(request, []*FetchResponse{small, large})
+	if len(errors) > 0 {
+		t.Fatalf("offload errors: %v", errors[0].Error)
+	}
+	if len(result) != 2 {
+		t.Fatalf("offload returned %d entries, want 2", len(result))
+	}
+	if small.StorageURL != "" {
+		t.Errorf("small entry offloaded to %s", small.StorageURL)
+	}
+
+	if len(s.objects) != 1 {
+		t.Fatalf("uploaded %d objects, want 1", len(s.objects))
+	}
+	o := s.objects[0]
+	name := urlHash(large.URL) + "/20160102T030405.000000006Z"
+	if o.Bucket != "bucket" || o.Name != name || o.ContentType != "text/html" ||
+		string(o.Content) != "0123456789" {
+		t.Errorf("uploaded %s/%s %s %q, want bucket/%s text/html %q",
+			o.Bucket, o.Name, o.ContentType, o.Content, name, "0123456789")
+	}
+	wantMeta := map[string]string{"url": large.URL, "final_url": large.FinalURL,
+		"content_hash": large.Hash}
+	if !reflect.DeepEqual(o.Metadata, wantMeta) {
+		t.Errorf("metadata = %v, want %v", o.Metadata, wantMeta)
+	}
+
+	ref := "gs://bucket/" + name
+	if large.StorageURL != ref {
+		t.Errorf("StorageURL = %q, want %q", large.StorageURL, ref)
+	}
+	m, err := f.message(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := base64.StdEncoding.DecodeString(m.Data)
+	if string(data) != ref || m.Attributes["storage_url"] != ref || m.Attributes["content_length"] != "10" {
+		t.Errorf("message data %q, attributes %v, want reference %s", data, m.Attributes, ref)
+	}
+
+	f.Format = FormatEnvelope
+	m, err = f.message(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = base64.StdEncoding.DecodeString(m.Data)
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.StorageURL != ref || env.Content != nil || env.Size != 10 {
+		t.Errorf("envelope %+v, want reference %s without content", env, ref)
+	}
+}
+
+func TestOffloadFailure(t *testing.T) {
+	s := newFakeStorage(t)
+	defer s.Close()
+	s.fail = true
+	f := storageFetcher(s)
+	f.OffloadBucket, f.OffloadThreshold = "bucket", 4
+
+	large := testEntry("http://a/large", "0123456789", time.Now())
+	result, errors := f.offload(&FetchRequest{Context: context.Background()}, []*FetchResponse{large})
+	if len(result) != 0 || len(errors) != 1 {
+		t.Fatalf("offload = %d entries, %d errors, want 0 and 1", len(result), len(errors))
+	}
+	if errors[0].Permanent || errors[0].Target != large.Target {
+		t.Errorf("offload error %+v, want transient error of the entry", errors[0])
+	}
+}
+
+func TestStorageSink(t *testing.T) {
+	s := newFakeStorage(t)
+	defer s.Close()
+	f := storageFetcher(s)
+
+	now := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	entries := []*FetchResponse{testEntry("http://a/1", "one", now), testEntry("http://a/2", "two", now)}
+	sink := &StorageSink{Bucket: "sink"}
+	errors, err := sink.Write(f, &FetchRequest{Context: context.Background()}, entries)
+	if err != nil || len(errors) > 0 {
+		t.Fatalf("Write = %v, %v", errors, err)
+	}
+	if len(s.objects) != 2 {
+		t.Fatalf("uploaded %d objects, want 2", len(s.objects))
+	}
+	for i, o := range s.objects {
+		e := entries[i]
+		if o.Bucket != "sink" || o.Name != objectName(e) || string(o.Content) != string(e.Content) ||
+			o.Metadata["url"] != e.URL {
+			t.Errorf("object %d = %+v, want %s of %s", i, o, objectName(e), e.URL)
+		}
+	}
+}
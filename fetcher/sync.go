@@ -0,0 +1,106 @@
+package fetcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"google.golang.org/appengine"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// OutcomeFailed marks the URLs that failed in a synchronous fetch
+const OutcomeFailed = "failed"
+
+// SyncResult is the JSON body of a ServeSync response.
+type SyncResult struct {
+	Entries []*Envelope `json:"entries"`
+	Errors  []URLError  `json:"errors,omitempty"`
+}
+
+func wantsMultipart(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "multipart"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "multipart/mixed")
+}
+
+// writeMultipart writes a multipart/mixed body with a part per entry,
+// holding its content, and a JSON URLError part per failed URL.
+func writeMultipart(w http.ResponseWriter, entries []*FetchResponse, errors []URLError) error {
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	w.WriteHeader(http.StatusOK)
+	for _, e := range entries {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", e.ContentType)
+		h.Set("Content-Location", e.URL)
+		h.Set("X-Fetcher-Final-Url", e.FinalURL)
+		h.Set("X-Fetcher-Status-Code", strconv.Itoa(e.StatusCode))
+		h.Set("X-Fetcher-Content-Hash", e.Hash)
+		if e.Truncated {
+			h.Set("X-Fetcher-Truncated", "true")
+		}
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		if _, err := part.Write(e.Content); err != nil {
+			return err
+		}
+	}
+	for _, e := range errors {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", "application/json")
+		h.Set("Content-Location", e.URL)
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		if err := json.NewEncoder(part).Encode(e); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// ServeSync fetches a FetchRequest and returns the content in the response
+// instead of publishing it, for interactive callers. Failed URLs are
+// reported, not retried, and conditional fetching, deduplication and
+// crawling don't apply; transformers do. The response is a SyncResult,
+// or multipart/mixed if asked for with format=multipart or the Accept
+// header.
+func (f *Fetcher) ServeSync(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	request := FetchRequest{Context: c, Request: r, sync: true}
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("fetcher: decoding request: %v", err))
+		return
+	}
+	request.Crawl = nil
+	if err := f.validate(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	result, errors := f.Fetch(&request)
+	errors, skipped := splitSkipped(errors)
+	result, rejected := f.transform(&request, result)
+	errors = append(errors, rejected...)
+
+	failures := append(urlErrors(errors, OutcomeFailed), urlErrors(skipped, OutcomeSkipped)...)
+	if wantsMultipart(r) {
+		// Headers are sent already, errors can only cut the body short
+		writeMultipart(w, result, failures)
+		return
+	}
+	res := SyncResult{Entries: make([]*Envelope, len(result)), Errors: failures}
+	for i, e := range result {
+		res.Entries[i] = envelope(e)
+	}
+	writeJSON(w, http.StatusOK, &res)
+}
@@ -0,0 +1,84 @@
+package fetcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Target is a single entry of FetchRequest.URLs. On the wire it is either a
+// plain URL string or an object with the optional method, headers and body.
+type Target struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+type target Target
+
+func (t *Target) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '"' {
+		*t = Target{}
+		return json.Unmarshal(data, &t.URL)
+	}
+	return json.Unmarshal(data, (*target)(t))
+}
+
+func (t Target) MarshalJSON() ([]byte, error) {
+	if t.Method == "" && len(t.Headers) == 0 && t.Body == "" {
+		return json.Marshal(t.URL)
+	}
+	return json.Marshal(target(t))
+}
+
+func Targets(urls ...string) []Target {
+	targets := make([]Target, len(urls))
+	for i := range urls {
+		targets[i].URL = urls[i]
+	}
+	return targets
+}
+
+// TargetError reports a target that can't be requested as given, such as
+// a malformed or non-http(s) URL. It is never retried.
+type TargetError struct {
+	URL string
+	Err error
+}
+
+func (e *TargetError) Error() string {
+	return fmt.Sprintf("fetcher: invalid target %s: %v", e.URL, e.Err)
+}
+
+func (f *Fetcher) newRequest(t *Target) (*http.Request, error) {
+	method := t.Method
+	if method == "" {
+		method = "GET"
+	}
+	var body io.Reader
+	if t.Body != "" {
+		body = strings.NewReader(t.Body)
+	}
+	req, err := http.NewRequest(strings.ToUpper(method), t.URL, body)
+	if err != nil {
+		return nil, &TargetError{URL: t.URL, Err: err}
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, &TargetError{URL: t.URL, Err: fmt.Errorf("unsupported scheme %q", req.URL.Scheme)}
+	}
+	if req.URL.Host == "" {
+		return nil, &TargetError{URL: t.URL, Err: fmt.Errorf("no host")}
+	}
+	if f.UserAgent != "" {
+		req.Header.Set("User-Agent", f.UserAgent)
+	}
+	for k, v := range t.Headers {
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
@@ -0,0 +1,109 @@
+package fetcher
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestTargetJSON(t *testing.T) {
+	tests := []struct {
+		json   string
+		target Target
+	}{
+		{`"http://a/"`, Target{URL: "http://a/"}},
+		{`{"url":"http://a/"}`, Target{URL: "http://a/"}},
+		{
+			`{"url":"http://a/","method":"POST","headers":{"X":"1"},"body":"b"}`,
+			Target{URL: "http://a/", Method: "POST", Headers: map[string]string{"X": "1"}, Body: "b"},
+		},
+	}
+	for _, test := range tests {
+		var got Target
+		if err := json.Unmarshal([]byte(test.json), &got); err != nil {
+			t.Errorf("Unmarshal(%s): %v", test.json, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.target) {
+			t.Errorf("Unmarshal(%s) = %+v, want %+v", test.json, got, test.target)
+		}
+	}
+}
+
+func TestTargetMarshalJSON(t *testing.T) {
+	tests := []struct {
+		target Target
+		json   string
+	}{
+		{Target{URL: "http://a/"}, `"http://a/"`},
+		{Target{URL: "http://a/", Method: "POST"}, `{"url":"http://a/","method":"POST"}`},
+		{Target{URL: "http://a/", Body: "b"}, `{"url":"http://a/","body":"b"}`},
+	}
+	for _, test := range tests {
+		got, err := json.Marshal(test.target)
+		if err != nil {
+			t.Errorf("Marshal(%+v): %v", test.target, err)
+			continue
+		}
+		if string(got) != test.json {
+			t.Errorf("Marshal(%+v) = %s, want %s", test.target, got, test.json)
+		}
+	}
+}
+
+func TestFetchRequestURLs(t *testing.T) {
+	// Requests from before Target still decode
+	var request FetchRequest
+	if err := json.Unmarshal([]byte(`{"urls":["http://a/",{"url":"http://b/","method":"HEAD"}],"topic":"t"}`), &request); err != nil {
+		t.Fatal(err)
+	}
+	want := []Target{{URL: "http://a/"}, {URL: "http://b/", Method: "HEAD"}}
+	if !reflect.DeepEqual(request.URLs, want) {
+		t.Errorf("URLs = %+v, want %+v", request.URLs, want)
+	}
+	content, err := json.Marshal(&request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"urls":["http://a/",{"url":"http://b/","method":"HEAD"}],"topic":"t"}`; string(content) != want {
+		t.Errorf("Marshal = %s, want %s", content, want)
+	}
+}
+
+func TestNewRequest(t *testing.T) {
+	f := &Fetcher{UserAgent: "agent"}
+	req, err := f.newRequest(&Target{URL: "http://a/", Method: "post",
+		Headers: map[string]string{"User-Agent": "other"}, Body: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != "POST" || req.Header.Get("User-Agent") != "other" || req.ContentLength != 1 {
+		t.Errorf("newRequest = %s %v %d", req.Method, req.Header, req.ContentLength)
+	}
+}
+
+func TestNewRequestInvalid(t *testing.T) {
+	f := &Fetcher{}
+	tests := []struct {
+		target Target
+		valid  bool
+	}{
+		{Target{URL: "http://a/"}, true},
+		{Target{URL: "HTTPS://a:8080/x?y"}, true},
+		{Target{URL: "ftp://a/"}, false},
+		{Target{URL: "mailto:a@b.c"}, false},
+		{Target{URL: "a.com/page"}, false},
+		{Target{URL: "http://[::1"}, false},
+		{Target{URL: "http:///path"}, false},
+		{Target{URL: "http://a/", Method: "BAD METHOD"}, false},
+	}
+	for _, test := range tests {
+		_, err := f.newRequest(&test.target)
+		if test.valid && err != nil {
+			t.Errorf("newRequest(%+v) = %v", test.target, err)
+		}
+		if !test.valid && (err == nil || !f.permanent(err)) {
+			t.Errorf("newRequest(%+v) = %v, want a permanent error", test.target, err)
+		}
+	}
+}
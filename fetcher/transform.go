@@ -0,0 +1,359 @@
+package fetcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"mime"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Transformer rewrites the content of a fetched entry before it is
+// published. Transformers expect Raw to be off.
+type Transformer interface {
+	Transform(f *Fetcher, request *FetchRequest, e *FetchResponse) error
+}
+
+// TransformSpec selects a transformer in FetchRequest.Transform by the name
+// of one of Fetcher.NamedTransformers or of a built-in one: "text",
+// "links" or "jsonpath", the latter taking Path.
+type TransformSpec struct {
+	Name string `json:"name"`
+	Path string `json:"path,omitempty"`
+}
+
+func (f *Fetcher) transformer(spec TransformSpec) (Transformer, error) {
+	if t, ok := f.NamedTransformers[spec.Name]; ok {
+		return t, nil
+	}
+	switch spec.Name {
+	case "text":
+		return &HTMLTextTransformer{}, nil
+	case "links":
+		return &LinkTransformer{}, nil
+	case "jsonpath":
+		return &JSONPathTransformer{Path: spec.Path}, nil
+	}
+	return nil, fmt.Errorf("fetcher: unknown transformer %q", spec.Name)
+}
+
+// transformers returns the chain selected by request, falling back to
+// Fetcher.Transformers.
+func (f *Fetcher) transformers(request *FetchRequest) ([]Transformer, error) {
+	if len(request.Transform) == 0 {
+		return f.Transformers, nil
+	}
+	chain := make([]Transformer, len(request.Transform))
+	for i, spec := range request.Transform {
+		t, err := f.transformer(spec)
+		if err != nil {
+			return nil, err
+		}
+		chain[i] = t
+	}
+	return chain, nil
+}
+
+// transform runs the transformer chain over entries. Entries it fails on
+// are returned as permanent errors.
+func (f *Fetcher) transform(request *FetchRequest, entries []*FetchResponse) (result []*FetchResponse, errors []*FetchError) {
+	chain, err := f.transformers(request)
+	if err != nil {
+		for _, e := range entries {
+			errors = append(errors, &FetchError{URL: e.URL, Target: e.Target,
+				Error: err, Permanent: true})
+		}
+		return nil, errors
+	}
+	if len(chain) == 0 {
+		return entries, nil
+	}
+entries:
+	for _, e := range entries {
+		for _, t := range chain {
+			if err := t.Transform(f, request, e); err != nil {
+				errors = append(errors, &FetchError{URL: e.URL, Target: e.Target,
+					Error: err, Permanent: true})
+				continue entries
+			}
+		}
+		e.Hash = contentHash(e.Content)
+		result = append(result, e)
+	}
+	return
+}
+
+func mediaType(contentType string) string {
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mediatype
+}
+
+func isHTML(contentType string) bool {
+	switch mediaType(contentType) {
+	case "text/html", "application/xhtml+xml":
+		return true
+	}
+	return false
+}
+
+// HTMLTextTransformer replaces HTML content by its visible text, one line
+// per block. Other content is left as it is.
+type HTMLTextTransformer struct{}
+
+var textSkipped = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Noscript: true,
+	atom.Template: true,
+}
+
+var textBlocks = map[atom.Atom]bool{
+	atom.Address: true, atom.Article: true, atom.Aside: true, atom.Blockquote: true,
+	atom.Br: true, atom.Dd: true, atom.Div: true, atom.Dl: true, atom.Dt: true,
+	atom.Figcaption: true, atom.Footer: true, atom.Form: true, atom.H1: true,
+	atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Header: true, atom.Hr: true, atom.Li: true, atom.Main: true, atom.Nav: true,
+	atom.Ol: true, atom.P: true, atom.Pre: true, atom.Section: true, atom.Table: true,
+	atom.Td: true, atom.Th: true, atom.Title: true, atom.Tr: true, atom.Ul: true,
+}
+
+func htmlText(content []byte) []byte {
+	var b bytes.Buffer
+	z := html.NewTokenizer(bytes.NewReader(content))
+	skip := 0
+	for tt := z.Next(); tt != html.ErrorToken; tt = z.Next() {
+		switch tt {
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			a := atom.Lookup(name)
+			switch {
+			case textSkipped[a] && tt == html.StartTagToken:
+				skip++
+			case textSkipped[a] && tt == html.EndTagToken && skip > 0:
+				skip--
+			case textBlocks[a]:
+				b.WriteByte('\n')
+			}
+		case html.TextToken:
+			if skip == 0 {
+				b.Write(z.Text())
+			}
+		}
+	}
+	var lines []string
+	for _, line := range strings.Split(b.String(), "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+func (t *HTMLTextTransformer) Transform(f *Fetcher, request *FetchRequest, e *FetchResponse) error {
+	if !isHTML(e.ContentType) {
+		return nil
+	}
+	e.Content = htmlText(e.Content)
+	e.ContentType = "text/plain; charset=utf-8"
+	return nil
+}
+
+// extractLinks returns the absolute http and https URLs linked from HTML
+// content, resolved against base or a <base> element, without fragments
+// and duplicates.
+func extractLinks(base *url.URL, content []byte) []string {
+	links := make([]string, 0)
+	seen := make(map[string]bool)
+	z := html.NewTokenizer(bytes.NewReader(content))
+	for tt := z.Next(); tt != html.ErrorToken; tt = z.Next() {
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		name, hasAttr := z.TagName()
+		a := atom.Lookup(name)
+		if a != atom.A && a != atom.Area && a != atom.Base {
+			continue
+		}
+		for hasAttr {
+			var key, value []byte
+			key, value, hasAttr = z.TagAttr()
+			if string(key) != "href" {
+				continue
+			}
+			u, err := base.Parse(strings.TrimSpace(string(value)))
+			if err != nil {
+				break
+			}
+			if a == atom.Base {
+				base = u
+				break
+			}
+			if u.Scheme != "http" && u.Scheme != "https" {
+				break
+			}
+			u.Fragment = ""
+			if link := u.String(); !seen[link] {
+				seen[link] = true
+				links = append(links, link)
+			}
+			break
+		}
+	}
+	return links
+}
+
+// LinkTransformer replaces HTML content by a JSON array of the URLs it
+// links to. Other content is left as it is.
+type LinkTransformer struct{}
+
+func (t *LinkTransformer) Transform(f *Fetcher, request *FetchRequest, e *FetchResponse) error {
+	if !isHTML(e.ContentType) {
+		return nil
+	}
+	base, err := url.Parse(e.FinalURL)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(extractLinks(base, e.Content))
+	if err != nil {
+		return err
+	}
+	e.Content = content
+	e.ContentType = "application/json"
+	return nil
+}
+
+type jsonStep struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// parseJSONPath parses the subset of JSONPath made of $, .key, ['key'],
+// [index], .* and [*].
+func parseJSONPath(path string) (steps []jsonStep, err error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("fetcher: json path %q doesn't start with $", path)
+	}
+	rest := path[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			i := strings.IndexAny(rest, ".[")
+			if i < 0 {
+				i = len(rest)
+			}
+			key := rest[:i]
+			if key == "" {
+				return nil, fmt.Errorf("fetcher: empty key in json path %q", path)
+			}
+			steps = append(steps, jsonStep{key: key, wildcard: key == "*"})
+			rest = rest[i:]
+		case '[':
+			i := strings.Index(rest, "]")
+			if i < 0 {
+				return nil, fmt.Errorf("fetcher: unclosed [ in json path %q", path)
+			}
+			sel := rest[1:i]
+			rest = rest[i+1:]
+			switch {
+			case sel == "*":
+				steps = append(steps, jsonStep{wildcard: true})
+			case len(sel) >= 2 && (sel[0] == '\'' || sel[0] == '"') && sel[len(sel)-1] == sel[0]:
+				steps = append(steps, jsonStep{key: sel[1 : len(sel)-1]})
+			default:
+				n, err := strconv.Atoi(sel)
+				if err != nil {
+					return nil, fmt.Errorf("fetcher: bad index %q in json path %q", sel, path)
+				}
+				steps = append(steps, jsonStep{index: n, isIndex: true})
+			}
+		default:
+			return nil, fmt.Errorf("fetcher: unexpected %q in json path %q", rest[0], path)
+		}
+	}
+	return
+}
+
+func (s jsonStep) apply(v interface{}) (result []interface{}) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		if s.wildcard {
+			// Go randomizes map order, sort the keys to keep the output stable
+			keys := make([]string, 0, len(x))
+			for k := range x {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				result = append(result, x[k])
+			}
+		} else if e, ok := x[s.key]; ok && !s.isIndex {
+			result = append(result, e)
+		}
+	case []interface{}:
+		if s.wildcard {
+			result = append(result, x...)
+		} else if s.isIndex {
+			i := s.index
+			if i < 0 {
+				i += len(x)
+			}
+			if i >= 0 && i < len(x) {
+				result = append(result, x[i])
+			}
+		}
+	}
+	return
+}
+
+// JSONPathTransformer replaces JSON content by the value selected by
+// Path, or an array of the values if Path contains a wildcard.
+type JSONPathTransformer struct {
+	Path string
+}
+
+func (t *JSONPathTransformer) Transform(f *Fetcher, request *FetchRequest, e *FetchResponse) error {
+	steps, err := parseJSONPath(t.Path)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(e.Content))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return fmt.Errorf("fetcher: decoding %s: %v", e.URL, err)
+	}
+	values, multiple := []interface{}{doc}, false
+	for _, s := range steps {
+		var next []interface{}
+		for _, v := range values {
+			next = append(next, s.apply(v)...)
+		}
+		values, multiple = next, multiple || s.wildcard
+	}
+	var selected interface{} = values
+	if !multiple {
+		if len(values) == 0 {
+			return fmt.Errorf("fetcher: %s has no %s", e.URL, t.Path)
+		}
+		selected = values[0]
+	} else if values == nil {
+		selected = []interface{}{}
+	}
+	content, err := json.Marshal(selected)
+	if err != nil {
+		return err
+	}
+	e.Content = content
+	e.ContentType = "application/json"
+	return nil
+}
@@ -0,0 +1,102 @@
+package fetcher
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseJSONPath(t *testing.T) {
+	tests := []struct {
+		path  string
+		steps []jsonStep
+		err   bool
+	}{
+		{"$", nil, false},
+		{"$.a.b", []jsonStep{{key: "a"}, {key: "b"}}, false},
+		{"$['a.b'][\"c\"]", []jsonStep{{key: "a.b"}, {key: "c"}}, false},
+		{"$.items[0][-1]", []jsonStep{{key: "items"}, {index: 0, isIndex: true}, {index: -1, isIndex: true}}, false},
+		{"$.*[*]", []jsonStep{{key: "*", wildcard: true}, {wildcard: true}}, false},
+		{"a.b", nil, true},
+		{"$..a", nil, true},
+		{"$[0", nil, true},
+		{"$[x]", nil, true},
+		{"$a", nil, true},
+	}
+	for _, test := range tests {
+		steps, err := parseJSONPath(test.path)
+		if (err != nil) != test.err {
+			t.Errorf("parseJSONPath(%q) error = %v, want error %v", test.path, err, test.err)
+			continue
+		}
+		if !test.err && !reflect.DeepEqual(steps, test.steps) {
+			t.Errorf("parseJSONPath(%q) = %+v, want %+v", test.path, steps, test.steps)
+		}
+	}
+}
+
+func TestJSONPathTransformer(t *testing.T) {
+	doc := `{"b": {"n": 2}, "a": {"n": 1}, "items": [{"id": "x"}, {"id": "y"}], "big": 12345678901234567890}`
+	tests := []struct {
+		path string
+		want string
+		err  bool
+	}{
+		{"$.a.n", `1`, false},
+		{"$.items[-1].id", `"y"`, false},
+		{"$.items[*].id", `["x","y"]`, false},
+		{"$.*.n", `[1,2]`, false},
+		{"$.big", `12345678901234567890`, false},
+		{"$.missing[*]", `[]`, false},
+		{"$.missing", ``, true},
+		{"$.items[5]", ``, true},
+	}
+	for _, test := range tests {
+		e := testEntry("http://a/", doc, testTime)
+		err := (&JSONPathTransformer{Path: test.path}).Transform(&Fetcher{}, &FetchRequest{}, e)
+		if (err != nil) != test.err {
+			t.Errorf("%s: error = %v, want error %v", test.path, err, test.err)
+			continue
+		}
+		if !test.err && string(e.Content) != test.want {
+			t.Errorf("%s = %s, want %s", test.path, e.Content, test.want)
+		}
+	}
+}
+
+func TestHTMLText(t *testing.T) {
+	tests := []struct {
+		html string
+		want string
+	}{
+		{"<p>Hello <b>world</b></p><p>Bye</p>", "Hello world\nBye"},
+		{"<title>T</title><script>var x;</script><style>p{}</style>body", "T\nbody"},
+		{"a<br>b<br/>  c   d  ", "a\nb\nc d"},
+		{"<ul><li>1</li><li>2</li></ul>", "1\n2"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := string(htmlText([]byte(test.html))); got != test.want {
+			t.Errorf("htmlText(%q) = %q, want %q", test.html, got, test.want)
+		}
+	}
+}
+
+func TestExtractLinks(t *testing.T) {
+	base, _ := url.Parse("http://a.com/dir/page")
+	tests := []struct {
+		html string
+		want []string
+	}{
+		{`<a href="x">x</a><a href="/y#frag">y</a>`, []string{"http://a.com/dir/x", "http://a.com/y"}},
+		{`<a href="x"></a><a href="x#b"></a>`, []string{"http://a.com/dir/x"}},
+		{`<base href="https://b.com/"><a href="x">`, []string{"https://b.com/x"}},
+		{`<a href="mailto:a@b.c"></a><a href="javascript:f()"></a>`, []string{}},
+		{`<area href=" http://c.com/ "><img src="http://d.com/i.png">`, []string{"http://c.com/"}},
+	}
+	for _, test := range tests {
+		if got := extractLinks(base, []byte(test.html)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("extractLinks(%q) = %q, want %q", test.html, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package fetcher
+
+import (
+	"encoding/json"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Number of entities listed per section of the admin page
+const adminListSize = 100
+
+// Period of the recent fetches listed on the admin page
+const adminHistoryPeriod = 24 * time.Hour
+
+const pageHTML = `
+<html>
+  <body>
+    {{ if .Executions }}
+    <h1>Recent Executions</h1>
+    <table>
+      <tr>
+        <th>Started</th><th>Duration</th><th>Queue</th><th>Attempt</th>
+        <th>Total</th><th>Success</th><th>Fail</th><th>Skipped</th>
+        <th>Unchanged</th><th>Duplicate</th><th>Dropped</th><th>Status Codes</th><th>Error</th>
+      </tr>
+      {{ range .Executions }}
+      <tr>
+        <td>{{ .Started }}</td><td>{{ .Duration }}</td><td>{{ .Queue }}</td><td>{{ .Attempt }}</td>
+        <td>{{ .Stat.Total }}</td><td>{{ .Stat.Success }}</td><td>{{ .Stat.Fail }}</td>
+        <td>{{ .Stat.Skipped }}</td><td>{{ .Stat.Unchanged }}</td><td>{{ .Stat.Duplicate }}</td>
+        <td>{{ .Stat.Dropped }}</td><td>{{ range $code, $n := .Stat.StatusCodes }}{{ $code }}: {{ $n }} {{ end }}</td>
+        <td>{{ .Error }}</td>
+      </tr>
+      {{ end }}
+    </table>
+    {{ end }}
+    {{ if .Failures }}
+    <h1>Failing URLs</h1>
+    <table>
+      <tr><th>URL</th><th>Error</th><th>Attempts</th><th>Permanent</th><th>Updated</th></tr>
+      {{ range .Failures }}
+      <tr>
+        <td>{{ .URL }}</td><td>{{ .Error }}</td><td>{{ .Attempts }}</td>
+        <td>{{ .Permanent }}</td><td>{{ .Updated }}</td>
+      </tr>
+      {{ end }}
+    </table>
+    {{ end }}
+    {{ if .Jobs }}
+    <h1>Jobs</h1>
+    <table>
+      <tr>
+        <th>Name</th><th>Interval</th><th>Disabled</th><th>Next Run</th>
+        <th>Last Run</th><th>Last Status</th><th>Last URLs</th><th>Last Error</th>
+      </tr>
+      {{ range .Jobs }}
+      <tr>
+        <td>{{ .Name }}</td><td>{{ .Interval }}</td><td>{{ .Disabled }}</td><td>{{ .NextRun }}</td>
+        <td>{{ .LastRun }}</td><td>{{ .LastStatus }}</td><td>{{ .LastURLs }}</td><td>{{ .LastError }}</td>
+      </tr>
+      {{ end }}
+    </table>
+    {{ end }}
+    {{ if .History }}
+    <h1>Recent Fetches</h1>
+    <table>
+      <tr><th>Fetched</th><th>URL</th><th>Status</th><th>Latency</th><th>Bytes</th><th>Error</th></tr>
+      {{ range .History }}
+      <tr>
+        <td>{{ .Fetched }}</td><td>{{ .URL }}</td><td>{{ .StatusCode }}</td>
+        <td>{{ .Latency }}</td><td>{{ .Bytes }}</td><td>{{ .Error }}</td>
+      </tr>
+      {{ end }}
+    </table>
+    {{ end }}
+    {{ if .DeadLetters }}
+    <h1>Dead Letters</h1>
+    {{ range .DeadLetters }}
+      <h2>{{ .URL }}</h2>
+      <ul>
+        <li>Topics: {{ range .Topics }}{{ . }} {{ end }}</li>
+        <li>Error: {{ .Error }}</li>
+        <li>Attempts: {{ .Attempts }}</li>
+        <li>Failed: {{ .Created }}</li>
+      </ul>
+      <form action="requeue/" method="post">
+        <input type="hidden" name="key" value="{{ .Key }}">
+        <input type="submit" value="Requeue">
+      </form>
+    {{ end }}
+    {{ end }}
+    <h1>Submit Request</h1>
+    <form action="submit/" method="post">
+    <p>URLs, one per line:</p>
+    <p><textarea name="urls" rows="10" cols="80"></textarea></p>
+    <p>Topic:</p>
+    <p><input type="text" name="topic"></p>
+    <p>Sink:</p>
+    <p><input type="text" name="sink"></p>
+    <p>Path:</p>
+    <p><input type="text" name="path" value="{{ .Path }}"></p>
+    <p>Queue:</p>
+    <p><input type="text" name="queue"></p>
+    <input type="submit">
+    </form>
+  </body>
+</html>
+`
+
+var pageTemplate = template.Must(template.New("page").Parse(pageHTML))
+
+type executionView struct {
+	*FetchExecution
+	Stat FetchStat
+}
+
+type deadLetterView struct {
+	*DeadLetter
+	Key string
+}
+
+type pageContext struct {
+	Executions  []*executionView
+	Failures    []*URLFailure
+	DeadLetters []*deadLetterView
+	Jobs        []*FetchJob
+	History     []*FetchRecord
+	Path        string
+}
+
+func (f *Fetcher) adminPage(ctx context.Context) (*pageContext, error) {
+	page := &pageContext{Path: f.AdminPath}
+	if f.ExecutionKind != "" {
+		var executions []*FetchExecution
+		q := datastore.NewQuery(f.ExecutionKind).Order("-Started").Limit(adminListSize)
+		if _, err := q.GetAll(ctx, &executions); err != nil {
+			return nil, err
+		}
+		for _, e := range executions {
+			v := &executionView{FetchExecution: e}
+			json.Unmarshal(e.Stat, &v.Stat)
+			page.Executions = append(page.Executions, v)
+		}
+	}
+	if f.FailureKind != "" {
+		q := datastore.NewQuery(f.FailureKind).Order("-Updated").Limit(adminListSize)
+		if _, err := q.GetAll(ctx, &page.Failures); err != nil {
+			return nil, err
+		}
+	}
+	if f.DeadLetterKind != "" {
+		var letters []*DeadLetter
+		q := datastore.NewQuery(f.DeadLetterKind).Order("-Created").Limit(adminListSize)
+		keys, err := q.GetAll(ctx, &letters)
+		if err != nil {
+			return nil, err
+		}
+		for i, l := range letters {
+			page.DeadLetters = append(page.DeadLetters,
+				&deadLetterView{DeadLetter: l, Key: keys[i].Encode()})
+		}
+	}
+	if f.AdminJobs != nil {
+		jobs, err := f.AdminJobs.Jobs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		page.Jobs = jobs
+	}
+	if f.HistoryKind != "" {
+		now := time.Now()
+		records, err := f.HistoryRange(ctx, now.Add(-adminHistoryPeriod), now, adminListSize)
+		if err != nil {
+			return nil, err
+		}
+		page.History = records
+	}
+	return page, nil
+}
+
+func (f *Fetcher) HandleAdminIndex(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	page, err := f.adminPage(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = pageTemplate.Execute(w, page)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// HandleAdminRequeue enqueues a dead-lettered URL again, with the options
+// of its request and its attempts reset, and deletes the dead letter. The
+// target lacks the sensitiveHeaders, which aren't stored.
+func (f *Fetcher) HandleAdminRequeue(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	key, err := datastore.DecodeKey(r.FormValue("key"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var letter DeadLetter
+	if err := datastore.Get(ctx, key, &letter); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var target Target
+	if err := json.Unmarshal(letter.Target, &target); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	request := &FetchRequest{}
+	if len(letter.Options) > 0 {
+		if err := json.Unmarshal(letter.Options, request); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	request.URLs, request.Topics = []Target{target}, letter.Topics
+	if err := addTask(ctx, request, letter.Path, letter.Queue); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := datastore.Delete(ctx, key); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "../", 301)
+}
+
+// HandleAdminSubmit enqueues an ad-hoc FetchRequest for the URLs entered.
+func (f *Fetcher) HandleAdminSubmit(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	var urls []string
+	for _, line := range strings.Split(r.FormValue("urls"), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			urls = append(urls, line)
+		}
+	}
+	path := r.FormValue("path")
+	if path == "" {
+		path = f.AdminPath
+	}
+	if len(urls) == 0 || path == "" {
+		http.Error(w, "fetcher: urls and path are required", http.StatusBadRequest)
+		return
+	}
+	request := &FetchRequest{URLs: Targets(urls...), Topic: r.FormValue("topic"),
+		Sink: r.FormValue("sink")}
+	if err := addTask(ctx, request, path, r.FormValue("queue")); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "../", 301)
+}
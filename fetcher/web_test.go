@@ -0,0 +1,29 @@
+package fetcher
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestAdminPageTemplate(t *testing.T) {
+	page := &pageContext{
+		Executions: []*executionView{{FetchExecution: &FetchExecution{Started: testTime},
+			Stat: FetchStat{Total: 3, StatusCodes: map[string]int{"200": 3}}}},
+		Failures:    []*URLFailure{{URL: "http://a/failure", Error: "boom"}},
+		DeadLetters: []*deadLetterView{{DeadLetter: &DeadLetter{URL: "http://a/dead"}, Key: "dead-key"}},
+		Jobs:        []*FetchJob{{Name: "nightly-job", LastStatus: JobError}},
+		History:     []*FetchRecord{{URL: "http://a/fetched", StatusCode: 200, Fetched: testTime}},
+		Path:        "/fetch",
+	}
+	var b bytes.Buffer
+	if err := pageTemplate.Execute(&b, page); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"200: 3", "http://a/failure", "dead-key", "nightly-job",
+		"http://a/fetched", `value="/fetch"`} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("admin page is missing %q", want)
+		}
+	}
+}